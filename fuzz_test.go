@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzProgram feeds arbitrary input to Program, which must neither panic
+// nor hang, and must leave a suffix of its input. Run it with
+//
+//	go test -run '^$' -fuzz FuzzProgram -fuzztime 1m
+//
+// Failing inputs are saved under testdata/fuzz/FuzzProgram and are run by
+// a plain "go test" from then on.
+func FuzzProgram(f *testing.F) {
+	for _, seed := range []string{
+		"1 + 2 * 3",
+		"x = 2\ny = x ^ -1\nx / y",
+		"f(a, b) = a + b\nf(1, 2)",
+		"`my var` = true\n-`my var` ^ 2",
+		"0x1.8p3 + 1_000.000_5",
+		"((((((1",
+		"f(f(f(f(f(",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		_, rest, _ := Parse(Program, input)
+		if !strings.HasSuffix(input, rest) {
+			t.Errorf("Program(%q) left %q, which is not a suffix of it", input, rest)
+		}
+	})
+}
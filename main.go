@@ -1,11 +1,22 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
 )
 
 type NodeType string
@@ -14,6 +25,55 @@ type Node struct {
 	Type     NodeType
 	Children []*Node
 	Value    string
+	Start    int
+	End      int
+	Attrs    map[string]interface{}
+}
+
+func (node *Node) Get(key string) (interface{}, bool) {
+	value, ok := node.Attrs[key]
+	return value, ok
+}
+
+func (node *Node) Set(key string, value interface{}) {
+	if node.Attrs == nil {
+		node.Attrs = make(map[string]interface{})
+	}
+	node.Attrs[key] = value
+}
+
+func (node *Node) Clone() *Node {
+	if node == nil {
+		return nil
+	}
+	clone := *node
+	clone.Children = make([]*Node, len(node.Children))
+	for i, child := range node.Children {
+		clone.Children[i] = child.Clone()
+	}
+	if node.Attrs != nil {
+		clone.Attrs = make(map[string]interface{}, len(node.Attrs))
+		for key, value := range node.Attrs {
+			clone.Attrs[key] = value
+		}
+	}
+	return &clone
+}
+
+// Equal compares the parsed structure only, ignoring offsets and Attrs.
+func (node *Node) Equal(other *Node) bool {
+	if node == nil || other == nil {
+		return node == other
+	}
+	if node.Type != other.Type || node.Value != other.Value || len(node.Children) != len(other.Children) {
+		return false
+	}
+	for i, child := range node.Children {
+		if !child.Equal(other.Children[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 func (node *Node) String() string {
@@ -25,6 +85,7 @@ func (node *Node) String() string {
 	}
 	output := string(node.Type) + "["
 	for i, child := range node.Children {
+		if child.Type == "OpMult" && child.Value == "" { continue }
 		if i > 0 && child.Type != Char { output += " " }
 		output += child.String()
 	}
@@ -39,39 +100,247 @@ const (
 type Parser func(input string) (node *Node, rest string, ok bool)
 
 func Digit(input string) (node *Node, rest string, ok bool) {
+	if step() {
+		return nil, "", false
+	}
 	if len(input) > 0 && input[0] >= '0' && input[0] <= '9' {
+		if allocate() {
+			return nil, "", false
+		}
 		return &Node{Type: Char, Value: input[:1]}, input[1:], true
 	}
-	return nil, "", false
+	return missed(input)
+}
+
+func Digits(outType NodeType, n int) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if len(input) < n {
+			return missed(input)
+		}
+		for i := 0; i < n; i++ {
+			if input[i] < '0' || input[i] > '9' {
+				return missed(input)
+			}
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: outType, Value: input[:n]}, input[n:], true
+	}
 }
 
 func Character(chr byte) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		if len(input) > 0 && input[0] == chr {
+			if allocate() {
+				return nil, "", false
+			}
 			return &Node{Type: Char, Value: input[:1]}, input[1:], true
 		}
+		return missed(input)
+	}
+}
+
+func Literal(outType NodeType, text string) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if !strings.HasPrefix(input, text) {
+			return missed(input)
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: outType, Value: text}, input[len(text):], true
+	}
+}
+
+// CaseInsensitiveKeywords lets Keyword match regardless of case. The node
+// still holds word as written in the grammar.
+var CaseInsensitiveKeywords = false
+
+func Keyword(outType NodeType, word string) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if len(input) < len(word) || continuesWord(input[len(word):]) {
+			return missed(input)
+		}
+		if input[:len(word)] != word && !(CaseInsensitiveKeywords && strings.EqualFold(input[:len(word)], word)) {
+			return missed(input)
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: outType, Value: word}, input[len(word):], true
+	}
+}
+
+func continuesWord(input string) bool {
+	if len(input) == 0 {
+		return false
+	}
+	chr := input[0]
+	return chr >= 'a' && chr <= 'z' || chr >= 'A' && chr <= 'Z' || chr >= '0' && chr <= '9'
+}
+
+// Quoted returns the text between two quote bytes, with escape dropped from
+// in front of whatever byte it precedes. When escape is the quote itself, a
+// doubled quote stands for one.
+func Quoted(outType NodeType, quote byte, escape byte) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if len(input) == 0 || input[0] != quote {
+			return missed(input)
+		}
+		value := []byte{}
+		for i := 1; i < len(input); i++ {
+			escaped := input[i] == escape && (escape != quote || i+1 < len(input) && input[i+1] == quote)
+			switch {
+			case escaped:
+				i++
+				if i < len(input) {
+					value = append(value, input[i])
+				}
+			case input[i] == quote:
+				if allocate() {
+					return nil, "", false
+				}
+				return &Node{Type: outType, Value: string(value)}, input[i+1:], true
+			default:
+				value = append(value, input[i])
+			}
+		}
+		return missed(input)
+	}
+}
+
+// Raw returns the text between two delimiters as it is, newlines and
+// backslashes included. Without a closing delimiter it fails, expecting
+// one at the end of the input.
+func Raw(outType NodeType, delimiter string) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if !strings.HasPrefix(input, delimiter) {
+			return missed(input)
+		}
+		end := strings.Index(input[len(delimiter):], delimiter)
+		if end < 0 {
+			expect("", "a closing "+delimiter)
+			return missed(input)
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		end += len(delimiter)
+		return &Node{Type: outType, Value: input[len(delimiter):end]}, input[end+len(delimiter):], true
+	}
+}
+
+func EOF(input string) (node *Node, rest string, ok bool) {
+	if step() {
+		return nil, "", false
+	}
+	if len(input) == 0 {
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: "EOF"}, "", true
+	}
+	return missed(input)
+}
+
+func EOL(input string) (node *Node, rest string, ok bool) {
+	if step() {
 		return nil, "", false
 	}
+	if len(input) == 0 {
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: "EOL"}, "", true
+	}
+	if input[0] == '\n' {
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: "EOL"}, input[1:], true
+	}
+	if strings.HasPrefix(input, "\r\n") {
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: "EOL"}, input[2:], true
+	}
+	return missed(input)
 }
 
 func Regex(outType NodeType, regex *regexp.Regexp) Parser {
+	regex = anchored(regex)
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		indexes := regex.FindStringIndex(input)
 		if indexes == nil || indexes[0] != 0 {
+			return missed(input)
+		}
+		if allocate() {
 			return nil, "", false
 		}
 		return &Node{Value: input[indexes[0]:indexes[1]], Type: outType}, input[indexes[1]:], true
 	}
 }
 
+// An unanchored regex would search the whole remaining input for a match
+// on every failed call, making long inputs take quadratic time.
+func anchored(regex *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile(`^(?:` + regex.String() + `)`)
+}
+
+func RegexAtLeast(outType NodeType, n int, regex *regexp.Regexp) Parser {
+	regex = anchored(regex)
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		indexes := regex.FindStringIndex(input)
+		if indexes == nil || indexes[0] != 0 || indexes[1] < n {
+			return missed(input)
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Value: input[:indexes[1]], Type: outType}, input[indexes[1]:], true
+	}
+}
+
 func Some(outType NodeType, parser Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
 		node = &Node{Type: outType}
 		rest = input
 		for {
 			parserNode, parserRest, parserOk := parser(rest)
 
-			if !parserOk {
+			if !parserOk || len(parserRest) == len(rest) {
 				return node, rest, true
 			}
 
@@ -83,13 +352,19 @@ func Some(outType NodeType, parser Parser) Parser {
 
 func AtLeast(outType NodeType, minimum int, parser Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		num := 0
+		if allocate() {
+			return nil, "", false
+		}
 		node = &Node{Type: outType}
 		rest = input
 		for {
 			parserNode, parserRest, parserOk := parser(rest)
 
-			if !parserOk {
+			if !parserOk || len(parserRest) == len(rest) {
 				if num >= minimum {
 					return node, rest, true
 				}
@@ -105,6 +380,9 @@ func AtLeast(outType NodeType, minimum int, parser Parser) Parser {
 
 func Or(parsers... Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		for _, parser := range parsers {
 			parserNode, parserRest, parserOk := parser(input)
 			if parserOk {
@@ -117,7 +395,13 @@ func Or(parsers... Parser) Parser {
 
 func Then(outType NodeType, parsers... Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		rest = input
+		if allocate() {
+			return nil, "", false
+		}
 		node = &Node{Type: outType}
 		for _, parser := range parsers {
 			parserNode, parserRest, parserOk := parser(rest)
@@ -133,7 +417,13 @@ func Then(outType NodeType, parsers... Parser) Parser {
 
 func ThenSkipping(outType NodeType, skip Parser, parsers... Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
 		rest = input
+		if allocate() {
+			return nil, "", false
+		}
 		node = &Node{Type: outType}
 		for _, parser := range parsers {
 			_, skipRest, skipOk := skip(rest)
@@ -152,129 +442,2975 @@ func ThenSkipping(outType NodeType, skip Parser, parsers... Parser) Parser {
 	}
 }
 
-func Skipping(skip Parser, parser Parser) Parser {
+func SepBy(outType NodeType, item Parser, sep Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
-		_, skipRest, skipOk := skip(input)
-		if skipOk {
-			input = skipRest
+		if step() {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType}
+		itemNode, rest, itemOk := item(input)
+		if !itemOk {
+			return node, input, true
+		}
+		node.Children = append(node.Children, itemNode)
+		for {
+			_, sepRest, sepOk := sep(rest)
+			if !sepOk {
+				return node, rest, true
+			}
+			itemNode, itemRest, itemOk := item(sepRest)
+			if !itemOk {
+				return node, rest, true
+			}
+			node.Children = append(node.Children, itemNode)
+			rest = itemRest
 		}
-		return parser(input)
 	}
 }
 
-func As(outType NodeType, parser Parser) Parser {
+// SepByAny is SepBy with several separators. A run of them, such as ",\n",
+// counts as one, so it doesn't stand for an empty item.
+func SepByAny(outType NodeType, item Parser, seps ...Parser) Parser {
+	return SepBy(outType, item, AtLeast(Whitespace, 1, Or(seps...)))
+}
+
+// CountedBy parses count, whose node's Value must be a non-negative
+// integer N, and then exactly N items. The node holds the count followed
+// by the items.
+func CountedBy(count Parser, item Parser) Parser {
 	return func(input string) (node *Node, rest string, ok bool) {
-		node = &Node{Type: outType}
-		parserNode, parserRest, parserOk := parser(input)
-		node.Children = []*Node{parserNode}
-		return node, parserRest, parserOk
+		if step() {
+			return nil, "", false
+		}
+		countNode, rest, ok := count(input)
+		if !ok {
+			return nil, "", false
+		}
+		n, err := strconv.Atoi(countNode.Value)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: "Counted", Children: []*Node{countNode}}
+		for i := 0; i < n; i++ {
+			itemNode, itemRest, itemOk := item(rest)
+			if !itemOk {
+				return nil, "", false
+			}
+			node.Children = append(node.Children, itemNode)
+			rest = itemRest
+		}
+		return node, rest, true
 	}
 }
 
-/////////////////////////// TEST SECTION //////////////////////////////////////
-
-func Eval(node *Node, memory Memory) float64 {
-	switch node.Type {
-	case "Expression":
-		return Eval(node.Children[0], memory)
-	case "Sum":
-		number := Eval(node.Children[0], memory)
-		for _, sum := range node.Children[1].Children {
-			if sum.Children[0].Type == "OpAdd" {
-				number += Eval(sum.Children[1], memory)
-			} else {
-				number -= Eval(sum.Children[1], memory)
-			}
+// ForEach parses the same lists as SepBy but hands each item to fn instead
+// of keeping it, so the node it returns has no children. Items are handed
+// over as soon as they are parsed, even if the parse later backtracks. An
+// error from fn fails the parse and becomes the message of its ParseError.
+func ForEach(item Parser, sep Parser, fn func(*Node) error) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
 		}
-		return number
-	case "Multiplication":
-		number := Eval(node.Children[0], memory)
-		for _, mult := range node.Children[1].Children {
-			if mult.Children[0].Type == "OpMult" {
-				number *= Eval(mult.Children[1], memory)
-			} else {
-				number /= Eval(mult.Children[1], memory)
+		rest = input
+		for first := true; ; first = false {
+			itemInput := rest
+			if !first {
+				_, sepRest, sepOk := sep(rest)
+				if !sepOk {
+					break
+				}
+				itemInput = sepRest
+			}
+			itemNode, itemRest, itemOk := item(itemInput)
+			if !itemOk {
+				break
+			}
+			if err := fn(itemNode); err != nil {
+				if tracked() && failure.err == nil {
+					failure.remaining = len(itemInput)
+					failure.err = err
+				}
+				return nil, "", false
 			}
+			rest = itemRest
 		}
-		return number
-	case "Unit":
-		return Eval(node.Children[1], memory)
-	case "Number":
-		number, _ := strconv.ParseFloat(node.Value, 64)
-		return number
-	case "Variable":
-		return memory.Variables[node.Value]
-	case "FunctionCall":
-		function := memory.Functions[node.Children[0].Value]
-		arguments := []float64{}
-		for _, argument := range node.Children[2].Children {
-			arguments = append(arguments, Eval(argument.Children[0], memory))
+		if allocate() {
+			return nil, "", false
 		}
-		variableCopy := make(map[string]float64)
-		for name, value := range memory.Variables {
-			variableCopy[name] = value
+		return &Node{Type: "ForEach"}, rest, true
+	}
+}
+
+// SepByTolerant treats a run of separators as one and skips any before the
+// first item or after the last, so "1,,2" and ",1,2," both give two items.
+func SepByTolerant(outType NodeType, item Parser, sep Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
 		}
-		for i, argument := range arguments {
-			if i < len(function.Parameters) {
-				variableCopy[function.Parameters[i]] = argument
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType}
+		rest, _ = skipAll(sep, input)
+		for {
+			itemNode, itemRest, itemOk := item(rest)
+			if !itemOk || len(itemRest) == len(rest) {
+				return node, rest, true
+			}
+			node.Children = append(node.Children, itemNode)
+			sepRest, separated := skipAll(sep, itemRest)
+			if !separated {
+				return node, itemRest, true
 			}
+			rest = sepRest
 		}
-		scopeMemory := Memory{variableCopy, memory.Functions}
-		return Eval(function.Expression, scopeMemory)
-	default:
-		return 0
 	}
 }
 
-type Memory struct {
-	Variables map[string]float64
-	Functions map[string]MemoryFunction
-}
-
-type MemoryFunction struct {
-	Parameters []string
-	Expression *Node
+func skipAll(parser Parser, input string) (rest string, skipped bool) {
+	rest = input
+	for {
+		_, parserRest, ok := parser(rest)
+		if !ok || len(parserRest) == len(rest) {
+			return rest, skipped
+		}
+		rest = parserRest
+		skipped = true
+	}
 }
 
-func Exec(program *Node) {
-	memory := Memory{make(map[string]float64), make(map[string]MemoryFunction)}
-	for _, node := range program.Children {
-		line := node.Children[0]
-		switch line.Type {
-		case "VariableDeclaration":
-			memory.Variables[line.Children[0].Value] = Eval(line.Children[2], memory)
-			fmt.Println(line.Children[0].Value, "=", memory.Variables[line.Children[0].Value])
-			break
-		case "Expression":
-			fmt.Println(Eval(line, memory))
-			break
-		case "FunctionDeclaration":
-			parameters := []string{}
-			for _, parameter := range line.Children[2].Children {
-				parameters = append(parameters, parameter.Children[0].Value)
+// Interleave parses a (b a)*, keeping every a and b as children in order.
+// A lone a is returned as is rather than wrapped.
+func Interleave(outType NodeType, a Parser, b Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		first, rest, ok := a(input)
+		if !ok {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType, Children: []*Node{first}}
+		for {
+			bNode, bRest, bOk := b(rest)
+			if !bOk {
+				break
 			}
-			memory.Functions[line.Children[0].Value] = MemoryFunction {
-				Parameters: parameters,
-				Expression: line.Children[5],
+			aNode, aRest, aOk := a(bRest)
+			if !aOk {
+				break
 			}
-			break
+			node.Children = append(node.Children, bNode, aNode)
+			rest = aRest
+		}
+		if len(node.Children) == 1 {
+			return first, rest, true
 		}
+		return node, rest, true
 	}
 }
 
-func Program(input string) (node *Node, rest string, ok bool) {
-	return Some("Lines", 
-		ThenSkipping("Line", WS,
-			Or(
-				Declaration,
-				Expression),
-			LineDelim))(input)
+func Trailing(outType NodeType, skip Parser, parser Parser, suffix... Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		first, rest, ok := Skipping(skip, parser)(input)
+		if !ok {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType, Children: []*Node{first}}
+		suffixRest := rest
+		for _, parser := range suffix {
+			parserNode, parserRest, parserOk := Skipping(skip, parser)(suffixRest)
+			if !parserOk {
+				return first, rest, true
+			}
+			node.Children = append(node.Children, parserNode)
+			suffixRest = parserRest
+		}
+		return node, suffixRest, true
+	}
 }
 
-func Declaration(input string) (node *Node, rest string, ok bool) {
-	return Or(
-		VariableDeclaration,
-		FunctionDeclaration,
+func Skipping(skip Parser, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		_, skipRest, skipOk := skip(input)
+		if skipOk {
+			input = skipRest
+		}
+		return parser(input)
+	}
+}
+
+// Trivia is what Token skips: spaces and "#" comments running to the end
+// of the line. It can be replaced to change what every Token skips.
+var Trivia Parser = SpacesAndComments("#")
+
+// SpacesAndComments skips spaces and comments that start with prefix and
+// run to the end of the line. Prefix followed by an operator character
+// doesn't start a comment, so that operators like "##" can still be used.
+func SpacesAndComments(prefix string) Parser {
+	comment := regexp.QuoteMeta(prefix) + `([^\n!#$%&*+./<=>?@^|~-][^\n]*|(?m:$))`
+	return Regex(Whitespace, regexp.MustCompile(`([ \r]|`+comment+`)*`))
+}
+
+// Token is the lexeme wrapper, skipping Trivia before parser.
+func Token(parser Parser) Parser {
+	return Skipping(func(input string) (*Node, string, bool) { return Trivia(input) }, parser)
+}
+
+// Prefixed is Skipping with a prefix that must match, like a "let" before a
+// declaration.
+func Prefixed(prefix Parser, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		_, prefixRest, prefixOk := prefix(input)
+		if !prefixOk {
+			return nil, "", false
+		}
+		return parser(prefixRest)
+	}
+}
+
+// Tagged reads an optional prefix and then parser, and names the result
+// present or absent depending on whether the prefix was there, as in a
+// declaration that is Mutable after "var" and Immutable without it. The
+// children are the prefix, or a Whitespace node, and the node of parser.
+func Tagged(present NodeType, absent NodeType, optional Parser, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		outType := present
+		prefix, prefixRest, prefixOk := optional(input)
+		if !prefixOk {
+			outType, prefix, prefixRest = absent, &Node{Type: Whitespace}, input
+		}
+		parserNode, rest, ok := parser(prefixRest)
+		if !ok {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		return &Node{Type: outType, Children: []*Node{prefix, parserNode}}, rest, true
+	}
+}
+
+// NotFollowedBy fails, consuming nothing, when lookahead matches right
+// after parser.
+func NotFollowedBy(parser Parser, lookahead Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if !ok {
+			return nil, "", false
+		}
+		if _, _, followed := lookahead(rest); followed {
+			return nil, "", false
+		}
+		return node, rest, true
+	}
+}
+
+// WithText passes capture the exact input that parser consumed.
+func WithText(parser Parser, capture func(text string)) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if ok {
+			capture(input[:len(input)-len(rest)])
+		}
+		return node, rest, ok
+	}
+}
+
+func Satisfy(parser Parser, pred func(*Node) bool) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if !ok || !pred(node) {
+			return nil, "", false
+		}
+		return node, rest, true
+	}
+}
+
+func As(outType NodeType, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType}
+		parserNode, parserRest, parserOk := parser(input)
+		node.Children = []*Node{parserNode}
+		return node, parserRest, parserOk
+	}
+}
+
+// Embed runs a parser from another grammar and wraps its node, keeping
+// the text it read in the "text" attribute. Unlike As it fails when the
+// inner parser does, so the outer grammar can try something else.
+func Embed(outType NodeType, inner Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		innerNode, rest, ok := inner(input)
+		if !ok {
+			return nil, "", false
+		}
+		if allocate() {
+			return nil, "", false
+		}
+		node = &Node{Type: outType, Children: []*Node{innerNode}}
+		node.Set("text", input[:len(input)-len(rest)])
+		return node, rest, true
+	}
+}
+
+type ParseError struct {
+	Offset   int
+	Expected []string
+	Message  string
+}
+
+func (err *ParseError) Error() string {
+	return err.message() + " at offset " + strconv.Itoa(err.Offset)
+}
+
+func (err *ParseError) message() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	if len(err.Expected) == 0 {
+		return "unexpected input"
+	}
+	return "expected " + strings.Join(err.Expected, " or ")
+}
+
+func FormatDiagnostic(filename string, err *ParseError, input string) string {
+	line, column := 1, 1
+	for i := 0; i < err.Offset && i < len(input); i++ {
+		if input[i] == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", filename, line, column, err.message())
+}
+
+// StepLimit caps how many combinator calls a single Parse may make, with 0
+// meaning no limit. Once it is exceeded every combinator fails. Parse and
+// the other entry points start counting from zero; parsers called
+// directly keep counting until ResetLimits.
+var StepLimit = 0
+var steps int64
+
+func step() bool {
+	if StepLimit == 0 {
+		return false
+	}
+	return atomic.AddInt64(&steps, 1) > int64(StepLimit)
+}
+
+// NodeLimit caps how many nodes a single Parse may allocate, counting
+// those of alternatives that are later dropped, with 0 meaning no limit.
+// Once it is exceeded every combinator that builds a node fails. It is
+// counted like StepLimit.
+var NodeLimit = 0
+var nodes int64
+
+func allocate() bool {
+	if NodeLimit == 0 {
+		return false
+	}
+	return atomic.AddInt64(&nodes, 1) > int64(NodeLimit)
+}
+
+func ResetLimits() {
+	atomic.StoreInt64(&steps, 0)
+	atomic.StoreInt64(&nodes, 0)
+}
+
+func stepLimitExceeded() bool {
+	return StepLimit > 0 && atomic.LoadInt64(&steps) > int64(StepLimit)
+}
+
+func nodeLimitExceeded() bool {
+	return NodeLimit > 0 && atomic.LoadInt64(&nodes) > int64(NodeLimit)
+}
+
+// failure is only written while tracking is on, so that parsers called
+// directly stay free of shared state and can run in several goroutines.
+var tracking int32
+
+var failure struct {
+	remaining int
+	expected  []string
+	err       error
+	// furthest is the shortest input a primitive parser has failed on, and
+	// length the length of the whole input.
+	missed   bool
+	furthest int
+	length   int
+}
+
+func tracked() bool {
+	return atomic.LoadInt32(&tracking) == 1
+}
+
+// missed is how primitive parsers fail, so that even unlabeled failures
+// leave a position behind.
+func missed(input string) (*Node, string, bool) {
+	if !tracked() {
+		return nil, "", false
+	}
+	if !failure.missed || len(input) < failure.furthest {
+		failure.furthest = len(input)
+	}
+	failure.missed = true
+	return nil, "", false
+}
+
+// LastFailureOffset is how far into the input given to
+// ResetFailureTracking a primitive parser got before failing, or -1 if
+// none has failed since.
+func LastFailureOffset() int {
+	if !failure.missed {
+		return -1
+	}
+	return failure.length - failure.furthest
+}
+
+// ResetFailureTracking starts tracking failures of parsers run on input.
+// Parse does this itself and stops again when it is done. While tracking
+// is on, parsers must not run in several goroutines at once.
+func ResetFailureTracking(input string) {
+	failure.missed = false
+	failure.length = len(input)
+	atomic.StoreInt32(&tracking, 1)
+}
+
+var parsing sync.Mutex
+
+func Label(name string, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if !ok && tracked() {
+			expect(input, name)
+		}
+		return node, rest, ok
+	}
+}
+
+// Expect is Label with the last word: when parser fails, message replaces
+// whatever else was expected at the same position.
+func Expect(parser Parser, message string) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if !ok && tracked() && failure.err == nil && (failure.expected == nil || len(input) <= failure.remaining) {
+			failure.remaining = len(input)
+			failure.expected = []string{message}
+		}
+		return node, rest, ok
+	}
+}
+
+// Block is Then(outType, open, body, close), except that a missing close
+// is reported right after the body. It is named "the end of the block"
+// unless something, such as a Label on close, was already expected there.
+func Block(outType NodeType, open Parser, body Parser, close Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = Then(outType, open, body)(input)
+		if !ok {
+			return nil, "", false
+		}
+		closeNode, closeRest, closeOk := close(rest)
+		if !closeOk {
+			if tracked() && (failure.expected == nil || failure.remaining > len(rest)) {
+				expect(rest, "the end of the block")
+			}
+			return nil, "", false
+		}
+		node.Children = append(node.Children, closeNode)
+		return node, closeRest, true
+	}
+}
+
+func expect(input string, name string) {
+	if !tracked() || failure.err != nil {
+		return
+	}
+	if failure.expected == nil || len(input) < failure.remaining {
+		failure.remaining = len(input)
+		failure.expected = []string{name}
+		return
+	}
+	if len(input) > failure.remaining {
+		return
+	}
+	for _, expected := range failure.expected {
+		if expected == name {
+			return
+		}
+	}
+	failure.expected = append(failure.expected, name)
+}
+
+func Parse(parser Parser, input string) (node *Node, rest string, err *ParseError) {
+	parsing.Lock()
+	defer parsing.Unlock()
+	failure.expected = nil
+	failure.err = nil
+	ResetFailureTracking(input)
+	defer atomic.StoreInt32(&tracking, 0)
+	ResetLimits()
+	ResetOperators()
+	node, rest, ok := parser(input)
+	if stepLimitExceeded() {
+		parsed := 0
+		if ok {
+			parsed = len(input) - len(rest)
+		}
+		return nil, input, &ParseError{Offset: parsed, Message: "step limit exceeded"}
+	}
+	if nodeLimitExceeded() {
+		return nil, input, &ParseError{Offset: 0, Message: "program too large"}
+	}
+	if ok {
+		return node, rest, nil
+	}
+	if failure.err != nil {
+		return nil, input, &ParseError{Offset: len(input) - failure.remaining, Message: failure.err.Error()}
+	}
+	if failure.expected == nil {
+		return nil, input, &ParseError{Offset: 0}
+	}
+	return nil, input, &ParseError{Offset: len(input) - failure.remaining, Expected: failure.expected}
+}
+
+type EventHandler interface {
+	Enter(nodeType NodeType)
+	Leave(nodeType NodeType, value string)
+}
+
+// ParseEvents runs p over input again and again, each time on what the
+// last run left, and reports the nodes it gives to handler in document
+// order, leaving out Whitespace. p is meant to read one statement, as
+// Statement does, and has to read something to get further; blank lines
+// and comments between statements are skipped. A node isn't final until
+// its statement is parsed, since an alternative can still be dropped, so
+// the events of a statement come once it is done and its tree is let go
+// of before the next one, keeping memory bounded by the largest statement.
+// Each run is a Parse of its own. It returns the input left after the last
+// statement, and whether that is all of it.
+func ParseEvents(p Parser, input string, handler EventHandler) (string, bool) {
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if node == nil || node.Type == Whitespace {
+			return
+		}
+		handler.Enter(node.Type)
+		for _, child := range node.Children {
+			walk(child)
+		}
+		handler.Leave(node.Type, node.Value)
+	}
+	// Parse starts Operators afresh, so the fixity declarations of earlier
+	// statements are put back before each one.
+	declared := map[string]Operator{}
+	resumed := func(input string) (*Node, string, bool) {
+		Operators = declared
+		return p(input)
+	}
+	rest := input
+	for {
+		if _, separatorsRest, err := Parse(optionalSeparators, rest); err == nil {
+			rest = separatorsRest
+		}
+		if rest == "" {
+			return rest, true
+		}
+		node, statementRest, err := Parse(resumed, rest)
+		if err != nil || len(statementRest) == len(rest) {
+			return rest, false
+		}
+		declared = Operators
+		walk(node)
+		rest = statementRest
+	}
+}
+
+type Grammar struct {
+	Skip    Parser
+	names   []string
+	rules   map[string]*Rule
+	parsers map[string]Parser
+}
+
+func (grammar *Grammar) Seq(outType NodeType, parsers ...Parser) Parser {
+	return ThenSkipping(outType, grammar.skip(), parsers...)
+}
+
+func (grammar *Grammar) Alt(parsers ...Parser) Parser {
+	alternatives := make([]Parser, len(parsers))
+	for i, parser := range parsers {
+		alternatives[i] = Skipping(grammar.skip(), parser)
+	}
+	return Or(alternatives...)
+}
+
+func (grammar *Grammar) Many(outType NodeType, parser Parser) Parser {
+	return Some(outType, Skipping(grammar.skip(), parser))
+}
+
+func (grammar *Grammar) skip() Parser {
+	if grammar.Skip == nil {
+		return Nothing
+	}
+	return grammar.Skip
+}
+
+func Nothing(input string) (node *Node, rest string, ok bool) {
+	if step() {
+		return nil, "", false
+	}
+	if allocate() {
+		return nil, "", false
+	}
+	return &Node{Type: Whitespace}, input, true
+}
+
+type RuleKind string
+
+const (
+	LiteralRule  RuleKind = "Literal"
+	PatternRule  RuleKind = "Pattern"
+	RefRule      RuleKind = "Ref"
+	SequenceRule RuleKind = "Sequence"
+	ChoiceRule   RuleKind = "Choice"
+	RepeatRule   RuleKind = "Repeat"
+	OptionalRule RuleKind = "Optional"
+	TagRule      RuleKind = "Tag"
+)
+
+type Rule struct {
+	Kind     RuleKind
+	Type     NodeType
+	Text     string
+	Minimum  int
+	Children []*Rule
+}
+
+func Lit(text string) *Rule {
+	return &Rule{Kind: LiteralRule, Type: Char, Text: text}
+}
+
+func Pat(outType NodeType, pattern string) *Rule {
+	return &Rule{Kind: PatternRule, Type: outType, Text: pattern}
+}
+
+func Ref(name string) *Rule {
+	return &Rule{Kind: RefRule, Text: name}
+}
+
+func Sequence(outType NodeType, rules ...*Rule) *Rule {
+	return &Rule{Kind: SequenceRule, Type: outType, Children: rules}
+}
+
+func Choice(rules ...*Rule) *Rule {
+	return &Rule{Kind: ChoiceRule, Children: rules}
+}
+
+func Repeat(outType NodeType, minimum int, rule *Rule) *Rule {
+	return &Rule{Kind: RepeatRule, Type: outType, Minimum: minimum, Children: []*Rule{rule}}
+}
+
+func Optional(rule *Rule) *Rule {
+	return &Rule{Kind: OptionalRule, Children: []*Rule{rule}}
+}
+
+func Tag(outType NodeType, rule *Rule) *Rule {
+	return &Rule{Kind: TagRule, Type: outType, Children: []*Rule{rule}}
+}
+
+func (grammar *Grammar) Define(name string, rule *Rule) {
+	if grammar.rules == nil {
+		grammar.rules = make(map[string]*Rule)
+		grammar.parsers = make(map[string]Parser)
+	}
+	if _, ok := grammar.rules[name]; !ok {
+		grammar.names = append(grammar.names, name)
+	}
+	grammar.rules[name] = rule
+	delete(grammar.parsers, name)
+}
+
+// Rules are compiled on first use, so they may refer to rules defined later.
+func (grammar *Grammar) Parser(name string) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		parser, compiled := grammar.parsers[name]
+		if !compiled {
+			rule, defined := grammar.rules[name]
+			if !defined {
+				return nil, "", false
+			}
+			parser = grammar.compile(rule)
+			grammar.parsers[name] = parser
+		}
+		return parser(input)
+	}
+}
+
+func (grammar *Grammar) compile(rule *Rule) Parser {
+	children := make([]Parser, len(rule.Children))
+	for i, child := range rule.Children {
+		children[i] = grammar.compile(child)
+	}
+	switch rule.Kind {
+	case LiteralRule:
+		return Literal(rule.Type, rule.Text)
+	case PatternRule:
+		return Regex(rule.Type, regexp.MustCompile(rule.Text))
+	case RefRule:
+		return grammar.Parser(rule.Text)
+	case SequenceRule:
+		return grammar.Seq(rule.Type, children...)
+	case ChoiceRule:
+		return grammar.Alt(children...)
+	case RepeatRule:
+		return AtLeast(rule.Type, rule.Minimum, Skipping(grammar.skip(), children[0]))
+	case OptionalRule:
+		return Or(children[0], Nothing)
+	case TagRule:
+		// A tagged literal keeps its text, so operators remember their spelling.
+		if rule.Children[0].Kind == LiteralRule {
+			return Literal(rule.Type, rule.Children[0].Text)
+		}
+		return As(rule.Type, children[0])
+	}
+	return nil
+}
+
+func (grammar *Grammar) EBNF() string {
+	output := ""
+	for _, name := range grammar.names {
+		output += name + " = " + grammar.rules[name].ebnf(false) + " ;\n"
+	}
+	return output
+}
+
+func (rule *Rule) ebnf(nested bool) string {
+	switch rule.Kind {
+	case LiteralRule:
+		return strconv.Quote(rule.Text)
+	case PatternRule:
+		return "? /" + rule.Text + "/ ?"
+	case RefRule:
+		return rule.Text
+	case SequenceRule:
+		parts := []string{}
+		for _, child := range rule.Children {
+			parts = append(parts, child.ebnf(true))
+		}
+		return strings.Join(parts, " ")
+	case ChoiceRule:
+		parts := []string{}
+		for _, child := range rule.Children {
+			parts = append(parts, child.ebnf(false))
+		}
+		if nested {
+			return "( " + strings.Join(parts, " | ") + " )"
+		}
+		return strings.Join(parts, " | ")
+	case RepeatRule:
+		output := "{ " + rule.Children[0].ebnf(false) + " }"
+		for i := 0; i < rule.Minimum; i++ {
+			output = rule.Children[0].ebnf(true) + " " + output
+		}
+		return output
+	case OptionalRule:
+		return "[ " + rule.Children[0].ebnf(false) + " ]"
+	case TagRule:
+		return rule.Children[0].ebnf(nested)
+	}
+	return ""
+}
+
+type Warning struct {
+	Rule    string
+	Message string
+}
+
+// CheckGrammar warns about Choice alternatives that can never be reached,
+// because an earlier alternative always matches first: one that can match
+// nothing, or a token such as Pat("Variable", ...) that matches the start
+// of every input a later alternative could match. It only looks at the
+// first token of each alternative, so it misses some cases.
+func CheckGrammar(grammar *Grammar) []Warning {
+	warnings := []Warning{}
+	var check func(name string, rule *Rule)
+	check = func(name string, rule *Rule) {
+		for _, child := range rule.Children {
+			check(name, child)
+		}
+		if rule.Kind != ChoiceRule {
+			return
+		}
+		for j, later := range rule.Children {
+			for i, earlier := range rule.Children[:j] {
+				if grammar.shadows(earlier, later) {
+					warnings = append(warnings, Warning{name, fmt.Sprintf(
+						"alternative %d (%s) can never match, alternative %d (%s) always matches first",
+						j+1, later.ebnf(false), i+1, earlier.ebnf(false))})
+					break
+				}
+			}
+		}
+	}
+	for _, name := range grammar.names {
+		check(name, grammar.rules[name])
+	}
+	return warnings
+}
+
+func (grammar *Grammar) shadows(earlier *Rule, later *Rule) bool {
+	if grammar.matchesEmpty(earlier, map[string]bool{}) {
+		return true
+	}
+	token := grammar.token(earlier, map[string]bool{})
+	text, ok := grammar.leadingLiteral(later, map[string]bool{})
+	if token == nil || !ok {
+		return false
+	}
+	if token.Kind == LiteralRule {
+		return strings.HasPrefix(text, token.Text)
+	}
+	return anchored(regexp.MustCompile(token.Text)).MatchString(text)
+}
+
+// resolve follows Refs and Tags, returning nil for a cycle or an undefined
+// rule.
+func (grammar *Grammar) resolve(rule *Rule, seen map[string]bool) *Rule {
+	for rule != nil && (rule.Kind == RefRule || rule.Kind == TagRule) {
+		if rule.Kind == TagRule {
+			rule = rule.Children[0]
+			continue
+		}
+		if seen[rule.Text] {
+			return nil
+		}
+		seen[rule.Text] = true
+		rule = grammar.rules[rule.Text]
+	}
+	return rule
+}
+
+func (grammar *Grammar) matchesEmpty(rule *Rule, seen map[string]bool) bool {
+	rule = grammar.resolve(rule, seen)
+	if rule == nil {
+		return false
+	}
+	switch rule.Kind {
+	case OptionalRule:
+		return true
+	case RepeatRule:
+		return rule.Minimum == 0
+	case PatternRule:
+		return anchored(regexp.MustCompile(rule.Text)).MatchString("")
+	case SequenceRule:
+		for _, child := range rule.Children {
+			if !grammar.matchesEmpty(child, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// token is the Lit or Pat a rule consists of, if it is a single one.
+func (grammar *Grammar) token(rule *Rule, seen map[string]bool) *Rule {
+	rule = grammar.resolve(rule, seen)
+	if rule == nil {
+		return nil
+	}
+	switch rule.Kind {
+	case LiteralRule, PatternRule:
+		return rule
+	case SequenceRule:
+		if len(rule.Children) == 1 {
+			return grammar.token(rule.Children[0], seen)
+		}
+	}
+	return nil
+}
+
+// leadingLiteral is the text every match of rule starts with, as long as
+// that text comes from a Lit.
+func (grammar *Grammar) leadingLiteral(rule *Rule, seen map[string]bool) (string, bool) {
+	rule = grammar.resolve(rule, seen)
+	if rule == nil {
+		return "", false
+	}
+	switch rule.Kind {
+	case LiteralRule:
+		return rule.Text, true
+	case SequenceRule:
+		if len(rule.Children) > 0 {
+			return grammar.leadingLiteral(rule.Children[0], seen)
+		}
+	case RepeatRule:
+		if rule.Minimum > 0 {
+			return grammar.leadingLiteral(rule.Children[0], seen)
+		}
+	}
+	return "", false
+}
+
+type Measurement struct {
+	Calls int
+	Bytes int
+}
+
+var MeasurementsEnabled = false
+var measurements = make(map[string]Measurement)
+
+func Measured(label string, parser Parser) Parser {
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = parser(input)
+		if !MeasurementsEnabled {
+			return node, rest, ok
+		}
+		measurement := measurements[label]
+		measurement.Calls++
+		if ok {
+			measurement.Bytes += len(input) - len(rest)
+		}
+		measurements[label] = measurement
+		return node, rest, ok
+	}
+}
+
+func ResetMeasurements() {
+	measurements = make(map[string]Measurement)
+}
+
+func Measurements() map[string]Measurement {
+	result := make(map[string]Measurement)
+	for label, measurement := range measurements {
+		result[label] = measurement
+	}
+	return result
+}
+
+// TypedParser is like Parser, but builds a value of type T instead of a
+// Node tree.
+type TypedParser[T any] func(input string) (value T, rest string, ok bool)
+
+// Typed turns a Parser into a TypedParser by converting its node.
+func Typed[T any](parser Parser, convert func(node *Node) T) TypedParser[T] {
+	return func(input string) (value T, rest string, ok bool) {
+		node, rest, ok := parser(input)
+		if !ok {
+			return value, "", false
+		}
+		return convert(node), rest, true
+	}
+}
+
+func MapT[A, B any](parser TypedParser[A], convert func(value A) B) TypedParser[B] {
+	return func(input string) (value B, rest string, ok bool) {
+		if step() {
+			return value, "", false
+		}
+		parsed, rest, ok := parser(input)
+		if !ok {
+			return value, "", false
+		}
+		return convert(parsed), rest, true
+	}
+}
+
+func ThenT[A, B, C any](first TypedParser[A], second TypedParser[B], combine func(a A, b B) C) TypedParser[C] {
+	return func(input string) (value C, rest string, ok bool) {
+		if step() {
+			return value, "", false
+		}
+		a, rest, ok := first(input)
+		if !ok {
+			return value, "", false
+		}
+		b, rest, ok := second(rest)
+		if !ok {
+			return value, "", false
+		}
+		return combine(a, b), rest, true
+	}
+}
+
+func OrT[T any](parsers... TypedParser[T]) TypedParser[T] {
+	return func(input string) (value T, rest string, ok bool) {
+		if step() {
+			return value, "", false
+		}
+		for _, parser := range parsers {
+			parsed, parserRest, parserOk := parser(input)
+			if parserOk {
+				return parsed, parserRest, true
+			}
+		}
+		return value, "", false
+	}
+}
+
+/////////////////////////// TEST SECTION //////////////////////////////////////
+
+func Eval(node *Node, memory Memory) (float64, error) {
+	if memory.budget != nil {
+		if *memory.budget <= 0 {
+			return 0, ErrBudgetExceeded
+		}
+		*memory.budget--
+	}
+	switch node.Type {
+	case "Expression":
+		return Eval(node.Children[0], memory)
+	case "Sum":
+		number, err := Eval(node.Children[0], memory)
+		if err != nil {
+			return 0, err
+		}
+		for i := 1; i < len(node.Children); i += 2 {
+			term, err := Eval(node.Children[i+1], memory)
+			if err != nil {
+				return 0, err
+			}
+			if node.Children[i].Type == "OpAdd" {
+				number += term
+			} else {
+				number -= term
+			}
+		}
+		return number, nil
+	case "Multiplication":
+		number, err := Eval(node.Children[0], memory)
+		if err != nil {
+			return 0, err
+		}
+		for i := 1; i < len(node.Children); i += 2 {
+			term, err := Eval(node.Children[i+1], memory)
+			if err != nil {
+				return 0, err
+			}
+			switch node.Children[i].Type {
+			case "OpMult":
+				number *= term
+			case "OpFloorDiv":
+				if term == 0 {
+					return 0, errors.New("division by zero")
+				}
+				number = math.Floor(number / term)
+			default:
+				number /= term
+			}
+		}
+		return number, nil
+	case "Negation":
+		number, err := Eval(node.Children[1], memory)
+		return -number, err
+	case "UnaryPlus":
+		return Eval(node.Children[1], memory)
+	case "Power":
+		base, err := Eval(node.Children[0], memory)
+		if err != nil {
+			return 0, err
+		}
+		exponent, err := Eval(node.Children[2], memory)
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	case "Unit":
+		return Eval(node.Children[1], memory)
+	case "Abs":
+		number, err := Eval(node.Children[1], memory)
+		return math.Abs(number), err
+	case "Sequence":
+		// Like C's comma operator, every part is evaluated and the last one
+		// is the value.
+		var number float64
+		for i := 0; i < len(node.Children); i += 2 {
+			value, err := Eval(node.Children[i], memory)
+			if err != nil {
+				return 0, err
+			}
+			number = value
+		}
+		return number, nil
+	case "Number":
+		if value, ok := node.Get("value"); ok {
+			return value.(float64), nil
+		}
+		return parseNumber(node.Value), nil
+	case "Variable":
+		if value, ok := memory.Variables[node.Value]; ok {
+			return value, nil
+		}
+		if value, ok := Constants[node.Value]; ok {
+			return value, nil
+		}
+		if _, ok := memory.Functions[node.Value]; ok {
+			return 0, fmt.Errorf("%s is a function, not a number", node.Value)
+		}
+		return 0, fmt.Errorf("undefined variable %s", node.Value)
+	case "Boolean":
+		if node.Value == "true" {
+			return 1, nil
+		}
+		return 0, nil
+	case "String":
+		return 0, fmt.Errorf("cannot use the string %q as a number, convert it with number(...)", node.Value)
+	case "MapLiteral":
+		return 0, errors.New("maps are not supported yet")
+	// Each operand of a chain is evaluated once, and the chain stops at the
+	// first comparison that fails.
+	case "Comparison", "ComparisonChain":
+		left, err := Eval(node.Children[0], memory)
+		if err != nil {
+			return 0, err
+		}
+		for i := 1; i < len(node.Children); i += 2 {
+			right, err := Eval(node.Children[i+1], memory)
+			if err != nil {
+				return 0, err
+			}
+			if !compare(node.Children[i].Type, left, right, memory.Options) {
+				return 0, nil
+			}
+			left = right
+		}
+		return 1, nil
+	case "Piecewise":
+		for _, clause := range node.Children {
+			if clause.Type == "Otherwise" {
+				return Eval(clause.Children[0], memory)
+			}
+			condition, err := Eval(clause.Children[2], memory)
+			if err != nil {
+				return 0, err
+			}
+			if truthy(condition) {
+				return Eval(clause.Children[0], memory)
+			}
+		}
+		return 0, errors.New("no clause applies and there is no otherwise")
+	case "Conditional":
+		condition, err := Eval(node.Children[1], memory)
+		if err != nil {
+			return 0, err
+		}
+		if truthy(condition) {
+			return Eval(node.Children[3], memory)
+		}
+		return Eval(node.Children[5], memory)
+	case "PrefixUpdate", "PostfixUpdate":
+		target, operator := node.Children[1], node.Children[0]
+		if node.Type == "PostfixUpdate" {
+			target, operator = node.Children[0], node.Children[1]
+		}
+		if target.Type != "Variable" {
+			return 0, fmt.Errorf("cannot apply %s to %s: only variables can be updated", operator.Value, target.Source())
+		}
+		old, ok := memory.Variables[target.Value]
+		if !ok {
+			return 0, fmt.Errorf("undefined variable %s", target.Value)
+		}
+		updated := old + 1
+		if operator.Type == "OpDecrement" {
+			updated = old - 1
+		}
+		memory.Variables[target.Value] = updated
+		if node.Type == "PostfixUpdate" {
+			return old, nil
+		}
+		return updated, nil
+	case "Let":
+		variableCopy := make(map[string]float64)
+		for name, value := range memory.Variables {
+			variableCopy[name] = value
+		}
+		scopeMemory := Memory{variableCopy, memory.Functions, memory.Options, memory.budget, memory.depth, memory.rationals, memory.globals}
+		for _, binding := range node.Children[1].Children {
+			value, err := Eval(binding.Children[2], scopeMemory)
+			if err != nil {
+				return 0, err
+			}
+			variableCopy[binding.Children[0].Value] = value
+		}
+		return Eval(node.Children[3], scopeMemory)
+	case "Range":
+		return 0, fmt.Errorf("cannot use the range %s as a number: lists are not supported yet", node.Source())
+	case "Cell", "CellRange":
+		if memory.Options.Cells == nil {
+			return 0, fmt.Errorf("cannot read the cell %s: there is no spreadsheet", node.Source())
+		}
+		return memory.Options.Cells(node)
+	case "Slice":
+		values, err := evalSlice(node, memory)
+		if err != nil {
+			return 0, err
+		}
+		return float64(len(values)), nil
+	case "FieldAccess":
+		return 0, fmt.Errorf("cannot read field %s: %s is not a record", node.Children[2].Value, node.Children[0].Source())
+	case "Operator":
+		left, err := Eval(node.Children[0], memory)
+		if err != nil {
+			return 0, err
+		}
+		right, err := Eval(node.Children[2], memory)
+		if err != nil {
+			return 0, err
+		}
+		function, ok := memory.Functions[node.Children[1].Value]
+		if !ok {
+			return 0, fmt.Errorf("undefined operator %s", node.Children[1].Value)
+		}
+		return Call(function, []float64{left, right}, memory)
+	case "FunctionCall":
+		if _, defined := memory.Functions["number"]; node.Children[0].Value == "number" && !defined {
+			return ConvertNumber(node.Children[2].Children, memory)
+		}
+		if isStringCall(node, memory) {
+			return 0, fmt.Errorf("cannot use the string %s as a number, convert it with number(...)", node.Source())
+		}
+		name := node.Children[0].Value
+		arguments, callMemory, passed, err := evalArguments(name, memory.Functions[name], node.Children[2].Children, memory, "(...)")
+		if err != nil {
+			return 0, err
+		}
+		return callByName(name, arguments, callMemory, passed)
+	case "Application":
+		_, value, isFunction, err := apply(node, memory)
+		if err != nil {
+			return 0, err
+		}
+		if isFunction {
+			return 0, fmt.Errorf("cannot use %s as a number, since it gives a function", node.Source())
+		}
+		return value, nil
+	default:
+		return 0, nil
+	}
+}
+
+var ErrBudgetExceeded = errors.New("operation budget exceeded")
+
+func compare(op NodeType, left, right float64, options EvalOptions) bool {
+	switch op {
+	case "OpLess":
+		return left < right
+	case "OpLessEqual":
+		return left <= right
+	case "OpGreater":
+		return left > right
+	case "OpGreaterEqual":
+		return left >= right
+	case "OpEqual":
+		return left == right
+	case "OpNotEqual":
+		return left != right
+	case "OpApprox":
+		epsilon := options.Epsilon
+		if epsilon == 0 {
+			epsilon = DefaultEpsilon
+		}
+		return math.Abs(left-right) <= epsilon
+	}
+	return false
+}
+
+// truthy is the one rule for what a condition means: zero and NaN are
+// false, every other number is true.
+func truthy(value float64) bool {
+	return value != 0 && !math.IsNaN(value)
+}
+
+// EvalWithBudget is Eval that gives up after maxOps nodes have been
+// evaluated, counting those inside every function call.
+func EvalWithBudget(node *Node, memory Memory, maxOps int) (float64, error) {
+	memory.budget = &maxOps
+	return Eval(node, memory)
+}
+
+func EvalBatch(exprs []string, env Memory) ([]float64, []error) {
+	results := make([]float64, len(exprs))
+	errs := make([]error, len(exprs))
+	for i, expr := range exprs {
+		node, rest, err := Parse(Expression, expr)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if _, _, atEnd := Skipping(WS, EOF)(rest); !atEnd {
+			errs[i] = &ParseError{Offset: len(expr) - len(rest), Expected: []string{"end of input"}}
+			continue
+		}
+		// Each expression gets its own copy, so "x++" in one doesn't
+		// change env for the next.
+		scope := env.Merge(NewMemory())
+		scope.budget = env.budget
+		results[i], errs[i] = Eval(node, scope)
+	}
+	return results, errs
+}
+
+var errInexact = errors.New("no exact rational value")
+
+const maxRationalExponent = 4096
+
+// EvalRational returns errInexact for anything it can't keep exact, such as
+// function calls, non-integer variables or fractional powers, in which case
+// callers are expected to fall back to Eval.
+func EvalRational(node *Node, memory Memory) (*big.Rat, error) {
+	switch node.Type {
+	case "Expression":
+		return EvalRational(node.Children[0], memory)
+	case "Unit":
+		return EvalRational(node.Children[1], memory)
+	case "Abs":
+		number, err := EvalRational(node.Children[1], memory)
+		if err != nil {
+			return nil, err
+		}
+		return number.Abs(number), nil
+	case "Sum":
+		number, err := EvalRational(node.Children[0], memory)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(node.Children); i += 2 {
+			term, err := EvalRational(node.Children[i+1], memory)
+			if err != nil {
+				return nil, err
+			}
+			if node.Children[i].Type == "OpAdd" {
+				number.Add(number, term)
+			} else {
+				number.Sub(number, term)
+			}
+		}
+		return number, nil
+	case "Multiplication":
+		number, err := EvalRational(node.Children[0], memory)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(node.Children); i += 2 {
+			term, err := EvalRational(node.Children[i+1], memory)
+			if err != nil {
+				return nil, err
+			}
+			if node.Children[i].Type == "OpMult" {
+				number.Mul(number, term)
+			} else if term.Sign() == 0 {
+				return nil, errInexact
+			} else {
+				number.Quo(number, term)
+			}
+			if node.Children[i].Type == "OpFloorDiv" {
+				// The denominator is positive, so Euclidean division floors.
+				number.SetInt(new(big.Int).Div(number.Num(), number.Denom()))
+			}
+		}
+		return number, nil
+	case "Negation":
+		number, err := EvalRational(node.Children[1], memory)
+		if err != nil {
+			return nil, err
+		}
+		return number.Neg(number), nil
+	case "UnaryPlus":
+		return EvalRational(node.Children[1], memory)
+	case "Power":
+		base, err := EvalRational(node.Children[0], memory)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := EvalRational(node.Children[2], memory)
+		if err != nil {
+			return nil, err
+		}
+		if !exponent.IsInt() || exponent.Num().CmpAbs(big.NewInt(maxRationalExponent)) > 0 || (base.Sign() == 0 && exponent.Sign() < 0) {
+			return nil, errInexact
+		}
+		if exponent.Sign() < 0 {
+			base.Inv(base)
+		}
+		times := new(big.Int).Abs(exponent.Num())
+		numerator := new(big.Int).Exp(base.Num(), times, nil)
+		denominator := new(big.Int).Exp(base.Denom(), times, nil)
+		return new(big.Rat).SetFrac(numerator, denominator), nil
+	case "Number":
+		number, ok := new(big.Rat).SetString(numberCleaner.Replace(node.Value))
+		if !ok {
+			return nil, errInexact
+		}
+		return number, nil
+	case "Boolean", "Variable":
+		value, err := Eval(node, memory)
+		if err != nil {
+			return nil, err
+		}
+		// A variable declared with an exact value keeps it, as long as it
+		// still holds that value.
+		if exact, ok := memory.rationals[node.Value]; ok && node.Type == "Variable" {
+			if float, _ := exact.Float64(); float == value {
+				return new(big.Rat).Set(exact), nil
+			}
+		}
+		if value != math.Trunc(value) || math.IsInf(value, 0) {
+			return nil, errInexact
+		}
+		return new(big.Rat).SetFloat64(value), nil
+	}
+	return nil, errInexact
+}
+
+// ConvertNumber is the number(...) built-in. It reads its string argument
+// with the same syntax as a literal, so number("1_000") is 1000.
+func ConvertNumber(arguments []*Node, memory Memory) (float64, error) {
+	if len(arguments) != 1 {
+		return 0, fmt.Errorf("number takes 1 argument, not %d", len(arguments))
+	}
+	if !isString(arguments[0], memory) {
+		return Eval(arguments[0], memory)
+	}
+	text, err := EvalString(arguments[0], memory)
+	if err != nil {
+		return 0, err
+	}
+	node, rest, ok := Number(strings.TrimSpace(text))
+	if !ok || rest != "" {
+		return 0, fmt.Errorf("cannot convert %q to a number", text)
+	}
+	return Eval(node, memory)
+}
+
+// EvalString is the value of node where a string is expected: a string
+// literal, or a string(...) call, which formats its number the way it is
+// printed in base 10, so string(3) is "3".
+func EvalString(node *Node, memory Memory) (string, error) {
+	node = unparenthesized(node)
+	if node.Type == "String" {
+		return node.Value, nil
+	}
+	if node.Type == "Sum" && isString(node, memory) {
+		text := ""
+		for i := 0; i < len(node.Children); i += 2 {
+			if !isString(node.Children[i], memory) {
+				return "", fmt.Errorf("cannot add %s to a string, convert it with string(...)", node.Children[i].Source())
+			}
+			term, err := EvalString(node.Children[i], memory)
+			if err != nil {
+				return "", err
+			}
+			text += term
+		}
+		return text, nil
+	}
+	if !isStringCall(node, memory) {
+		return "", fmt.Errorf("%s is not a string", node.Source())
+	}
+	arguments := node.Children[2].Children
+	if len(arguments) != 1 {
+		return "", fmt.Errorf("string takes 1 argument, not %d", len(arguments))
+	}
+	if isString(arguments[0], memory) {
+		return EvalString(arguments[0], memory)
+	}
+	value, err := Eval(arguments[0], memory)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(value), nil
+}
+
+// isString also holds for a sum of only "+" with a string among its terms,
+// so that EvalString can report the terms that aren't strings.
+func isString(node *Node, memory Memory) bool {
+	node = unparenthesized(node)
+	if node.Type == "Sum" {
+		concatenation := false
+		for i, child := range node.Children {
+			if i%2 == 1 && child.Type != "OpAdd" {
+				return false
+			}
+			concatenation = concatenation || i%2 == 0 && isString(child, memory)
+		}
+		return concatenation
+	}
+	return node.Type == "String" || isStringCall(node, memory)
+}
+
+func isStringCall(node *Node, memory Memory) bool {
+	_, defined := memory.Functions["string"]
+	return node.Type == "FunctionCall" && node.Children[0].Value == "string" && !defined
+}
+
+func unparenthesized(node *Node) *Node {
+	for node.Type == "Expression" || node.Type == "Unit" && len(node.Children) == 3 {
+		node = node.Children[len(node.Children)/2]
+	}
+	return node
+}
+
+// evalArguments evaluates the arguments of a call to function, named name.
+// When function is a user function, an argument that is just the name of
+// another function, or a partial application, passes that function: the
+// parameter can then be called like it, but not used as a number. The
+// returned memory has those parameters among its functions, for the callee
+// to see, and passed holds their names.
+func evalArguments(name string, function MemoryFunction, nodes []*Node, memory Memory, call string) (arguments []float64, callMemory Memory, passed map[string]bool, err error) {
+	arguments = []float64{}
+	var functions map[string]MemoryFunction
+	for i, argument := range nodes {
+		parameter := len(function.Applied) + i
+		bindable := parameter < len(function.Parameters) && !(function.Variadic && parameter == len(function.Parameters)-1)
+		argumentFunction, ok := functionArgument(argument, memory)
+		if application := unparenthesized(argument); !ok && bindable && application.Type == "Application" {
+			// The application is evaluated here either way, so that it
+			// runs only once.
+			var value float64
+			argumentFunction, value, ok, err = apply(application, memory)
+			if err != nil {
+				return nil, memory, nil, fmt.Errorf("error in argument %d of %s%s: %w", i+1, name, call, err)
+			}
+			if !ok {
+				arguments = append(arguments, value)
+				continue
+			}
+		}
+		if ok && bindable {
+			if functions == nil {
+				functions = make(map[string]MemoryFunction, len(memory.Functions)+1)
+				for functionName, other := range memory.Functions {
+					functions[functionName] = other
+				}
+				passed = make(map[string]bool)
+			}
+			functions[function.Parameters[parameter]] = argumentFunction
+			passed[function.Parameters[parameter]] = true
+			arguments = append(arguments, math.NaN())
+			continue
+		}
+		value, err := Eval(argument, memory)
+		if err != nil {
+			return nil, memory, nil, fmt.Errorf("error in argument %d of %s%s: %w", i+1, name, call, err)
+		}
+		arguments = append(arguments, value)
+	}
+	if functions != nil {
+		memory = Memory{memory.Variables, functions, memory.Options, memory.budget, memory.depth, memory.rationals, memory.globals}
+	}
+	return arguments, memory, passed, nil
+}
+
+// functionArgument is the function a bare name stands for, as long as no
+// variable or constant has that name.
+func functionArgument(argument *Node, memory Memory) (MemoryFunction, bool) {
+	for argument.Type == "Expression" && len(argument.Children) == 1 {
+		argument = argument.Children[0]
+	}
+	if argument.Type != "Variable" {
+		return MemoryFunction{}, false
+	}
+	name := argument.Value
+	if _, ok := memory.Variables[name]; ok {
+		return MemoryFunction{}, false
+	}
+	if _, ok := Constants[name]; ok {
+		return MemoryFunction{}, false
+	}
+	if function, ok := memory.Functions[name]; ok {
+		return function, true
+	}
+	if _, ok := Builtins[name]; ok {
+		return MemoryFunction{Builtin: name}, true
+	}
+	return MemoryFunction{}, false
+}
+
+// evalSlice gives the values of a Slice like xs(2:4), which goes up to
+// but not including its end. Either bound may be left out, and a negative
+// one counts from the end, so xs(-2:) is the last two values.
+func evalSlice(node *Node, memory Memory) ([]float64, error) {
+	name := node.Children[0].Value
+	function, ok := memory.Functions[name]
+	if !ok || function.Values == nil {
+		return nil, fmt.Errorf("cannot slice %s: it is not an argument list", name)
+	}
+	length := len(function.Values)
+	bounds := []int{1, length + 1}
+	for i, bound := range []*Node{node.Children[2], node.Children[4]} {
+		if bound.Type == Whitespace {
+			continue
+		}
+		value, err := Eval(bound, memory)
+		if err != nil {
+			return nil, err
+		}
+		index := int(value)
+		if float64(index) != value {
+			return nil, fmt.Errorf("slice bound %v of %s is not an integer", value, node.Source())
+		}
+		if index < 0 {
+			index += length + 1
+		}
+		bounds[i] = index
+	}
+	if bounds[0] < 1 || bounds[1] > length+1 || bounds[0] > bounds[1] {
+		return nil, fmt.Errorf("slice %s is out of range 1 to %d", node.Source(), length)
+	}
+	return function.Values[bounds[0]-1 : bounds[1]-1], nil
+}
+
+func CallByName(name string, arguments []float64, memory Memory) (float64, error) {
+	return callByName(name, arguments, memory, nil)
+}
+
+func callByName(name string, arguments []float64, memory Memory, passed map[string]bool) (float64, error) {
+	if function, ok := memory.Functions[name]; ok {
+		return call(function, arguments, memory, passed)
+	}
+	if _, ok := Builtins[name]; ok {
+		return callBuiltin(name, arguments, memory)
+	}
+	return 0, fmt.Errorf("undefined function %s", name)
+}
+
+func callBuiltin(name string, arguments []float64, memory Memory) (float64, error) {
+	if memory.Options.SafeMode && Impure[name] {
+		return 0, fmt.Errorf("%s is not allowed in safe mode", name)
+	}
+	return Builtins[name](arguments, memory.Options), nil
+}
+
+// MaxCallDepth is how deeply user functions may call each other before
+// Call gives up, since recover can't catch the stack overflowing.
+var MaxCallDepth = 10000
+
+func Call(function MemoryFunction, arguments []float64, memory Memory) (float64, error) {
+	return call(function, arguments, memory, nil)
+}
+
+// call is Call where the parameters in passed were given functions, so
+// they are left out of the variables.
+func call(function MemoryFunction, arguments []float64, memory Memory, passed map[string]bool) (float64, error) {
+	if function.Builtin != "" {
+		return callBuiltin(function.Builtin, arguments, memory)
+	}
+	if function.Values != nil {
+		if len(arguments) != 1 {
+			return 0, fmt.Errorf("an argument list takes 1 index, not %d", len(arguments))
+		}
+		index, length := int(arguments[0]), len(function.Values)
+		if float64(index) != arguments[0] || index == 0 || index > length || index < -length {
+			return 0, fmt.Errorf("index %v is out of range 1 to %d", arguments[0], length)
+		}
+		if index < 0 {
+			index += length + 1
+		}
+		return function.Values[index-1], nil
+	}
+	scopeMemory, err := bind(function, arguments, memory, passed)
+	if err != nil {
+		return 0, err
+	}
+	return Eval(function.Expression, scopeMemory)
+}
+
+// bind gives the memory the body of function runs in, with its parameters
+// set to the arguments, after those it was already applied to.
+func bind(function MemoryFunction, arguments []float64, memory Memory, passed map[string]bool) (Memory, error) {
+	if memory.depth >= MaxCallDepth {
+		return memory, fmt.Errorf("too deep recursion: more than %d nested calls", MaxCallDepth)
+	}
+	variableCopy := make(map[string]float64)
+	for name, value := range memory.Variables {
+		variableCopy[name] = value
+	}
+	arguments = append(append([]float64{}, function.Applied...), arguments...)
+	functions := memory.Functions
+	fixed := len(function.Parameters)
+	if function.Variadic {
+		fixed--
+		rest := []float64{}
+		if len(arguments) > fixed {
+			rest = append(rest, arguments[fixed:]...)
+		}
+		name := function.Parameters[fixed]
+		variableCopy[name] = float64(len(rest))
+		functions = make(map[string]MemoryFunction, len(memory.Functions)+1)
+		for functionName, other := range memory.Functions {
+			functions[functionName] = other
+		}
+		functions[name] = MemoryFunction{Values: rest}
+	}
+	for i, argument := range arguments {
+		if i < fixed && passed[function.Parameters[i]] {
+			delete(variableCopy, function.Parameters[i])
+		} else if i < fixed {
+			variableCopy[function.Parameters[i]] = argument
+		}
+	}
+	scopeMemory := Memory{variableCopy, functions, memory.Options, memory.budget, memory.depth + 1, memory.rationals, memory.globals}
+	for i := len(arguments); i < len(function.Defaults); i++ {
+		if function.Defaults[i] == nil {
+			continue
+		}
+		// A default sees the variables where the function was declared and
+		// the parameters before it, not the variables of the caller.
+		defaultVariables := make(map[string]float64, len(memory.globals)+i)
+		for name, value := range memory.globals {
+			defaultVariables[name] = value
+		}
+		for _, parameter := range function.Parameters[:i] {
+			if value, ok := variableCopy[parameter]; ok {
+				defaultVariables[parameter] = value
+			} else {
+				delete(defaultVariables, parameter)
+			}
+		}
+		defaultMemory := Memory{defaultVariables, functions, memory.Options, memory.budget, memory.depth + 1, memory.rationals, memory.globals}
+		value, err := Eval(function.Defaults[i], defaultMemory)
+		if err != nil {
+			return memory, fmt.Errorf("error in the default of %s: %w", function.Parameters[i], err)
+		}
+		variableCopy[function.Parameters[i]] = value
+	}
+	return scopeMemory, nil
+}
+
+// apply evaluates an Application curried, so "f x y" is "(f x) y": a user
+// function takes as many arguments as it has parameters left, and the
+// function its body stands for takes the rest. When fewer arguments remain
+// than a user function needs, it is given back partly applied. Other
+// functions take all the arguments left. isFunction is set when the result
+// is a function, which only a parameter can hold, rather than value.
+func apply(node *Node, memory Memory) (function MemoryFunction, value float64, isFunction bool, err error) {
+	name := node.Children[0].Value
+	nodes := node.Children[1].Children
+	function, ok := memory.Functions[name]
+	if _, builtin := Builtins[name]; !ok && builtin {
+		function, ok = MemoryFunction{Builtin: name}, true
+	}
+	if !ok {
+		return function, 0, false, fmt.Errorf("undefined function %s", name)
+	}
+	for {
+		taken := len(nodes)
+		if function.Builtin == "" && function.Values == nil && !function.Variadic {
+			left := len(function.Parameters) - len(function.Applied)
+			if len(nodes) < left-optionalParameters(function) {
+				arguments, _, passed, err := evalArguments(name, function, nodes, memory, " ...")
+				if err != nil {
+					return function, 0, false, err
+				}
+				if len(passed) > 0 {
+					return function, 0, false, fmt.Errorf("cannot partly apply %s to a function", name)
+				}
+				function.Applied = append(append([]float64{}, function.Applied...), arguments...)
+				return function, 0, true, nil
+			}
+			if left < taken {
+				taken = left
+			}
+		}
+		arguments, callMemory, passed, err := evalArguments(name, function, nodes[:taken], memory, " ...")
+		if err != nil {
+			return function, 0, false, err
+		}
+		if function.Builtin != "" || function.Values != nil {
+			value, err := call(function, arguments, callMemory, passed)
+			return function, value, false, err
+		}
+		scopeMemory, err := bind(function, arguments, callMemory, passed)
+		if err != nil {
+			return function, 0, false, err
+		}
+		body := unparenthesized(function.Expression)
+		next, isFunction := functionArgument(body, scopeMemory)
+		if !isFunction && body.Type == "Application" {
+			next, value, isFunction, err = apply(body, scopeMemory)
+			if err != nil || !isFunction && taken == len(nodes) {
+				return function, value, false, err
+			}
+		}
+		if taken == len(nodes) {
+			if isFunction {
+				return next, 0, true, nil
+			}
+			value, err := Eval(function.Expression, scopeMemory)
+			return function, value, false, err
+		}
+		for _, argument := range nodes[:taken] {
+			name += " " + argument.Source()
+		}
+		if !isFunction {
+			return function, 0, false, fmt.Errorf("%s is a number, so it can't be applied to %s", name, nodes[taken].Source())
+		}
+		function, nodes = next, nodes[taken:]
+	}
+}
+
+// optionalParameters is how many of the parameters of function have
+// defaults.
+func optionalParameters(function MemoryFunction) int {
+	optional := 0
+	for _, value := range function.Defaults {
+		if value != nil {
+			optional++
+		}
+	}
+	return optional
+}
+
+// Function parameters are not reads inside their own body, and the names
+// of called or declared functions are not variables at all.
+func (program *Node) FreeVariables() (reads, writes []string) {
+	read := make(map[string]bool)
+	written := make(map[string]bool)
+	var walk func(node *Node, bound map[string]bool)
+	walk = func(node *Node, bound map[string]bool) {
+		switch node.Type {
+		case "Variable":
+			if !bound[node.Value] && !read[node.Value] {
+				read[node.Value] = true
+				reads = append(reads, node.Value)
+			}
+			return
+		case "VariableDeclaration":
+			if !written[node.Children[0].Value] {
+				written[node.Children[0].Value] = true
+				writes = append(writes, node.Children[0].Value)
+			}
+			walk(node.Children[2], bound)
+			return
+		case "FunctionDeclaration":
+			scope := make(map[string]bool)
+			for name := range bound {
+				scope[name] = true
+			}
+			for _, parameter := range node.Children[2].Children {
+				walk(parameter.Children[1], scope)
+				scope[parameter.Children[0].Value] = true
+			}
+			walk(node.Children[5], scope)
+			return
+		case "OperatorDeclaration":
+			scope := make(map[string]bool)
+			for name := range bound {
+				scope[name] = true
+			}
+			scope[node.Children[0].Value] = true
+			scope[node.Children[2].Value] = true
+			walk(node.Children[4], scope)
+			return
+		case "PrefixUpdate", "PostfixUpdate":
+			for _, child := range node.Children {
+				if child.Type == "Variable" && !bound[child.Value] && !written[child.Value] {
+					written[child.Value] = true
+					writes = append(writes, child.Value)
+				}
+				walk(child, bound)
+			}
+			return
+		case "Let":
+			scope := make(map[string]bool)
+			for name := range bound {
+				scope[name] = true
+			}
+			for _, binding := range node.Children[1].Children {
+				walk(binding.Children[2], scope)
+				scope[binding.Children[0].Value] = true
+			}
+			walk(node.Children[3], scope)
+			return
+		case "FunctionCall", "Application", "Slice":
+			for _, child := range node.Children[1:] {
+				walk(child, bound)
+			}
+			return
+		case "FieldAccess":
+			walk(node.Children[0], bound)
+			return
+		case "MapEntry":
+			walk(node.Children[2], bound)
+			return
+		}
+		for _, child := range node.Children {
+			walk(child, bound)
+		}
+	}
+	walk(program, make(map[string]bool))
+	return reads, writes
+}
+
+// Source prints the node back as calculator input. Whitespace is
+// normalised, but operators keep the spelling they were written with.
+func (node *Node) Source() string {
+	children := make([]string, len(node.Children))
+	for i, child := range node.Children {
+		children[i] = child.Source()
+	}
+	switch node.Type {
+	case Whitespace:
+		return ""
+	case "Variable":
+		if !plainIdentifier.MatchString(node.Value) || Keywords[node.Value] {
+			return "`" + strings.ReplaceAll(node.Value, "`", "``") + "`"
+		}
+		return node.Value
+	case "Number":
+		if unit, ok := node.Get("unit"); ok {
+			return node.Value + unit.(string)
+		}
+		return node.Value
+	case "Lines":
+		lines := []string{}
+		for _, line := range children {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	case "Range":
+		for _, child := range node.Children {
+			if len(child.Children) > 0 {
+				return strings.Join(children, " ")
+			}
+		}
+		return strings.Join(children, "")
+	case "Negation", "UnaryPlus", "Unit", "Abs", "FieldAccess", "Slice", "SliceRange", "PrefixUpdate", "PostfixUpdate":
+		return strings.Join(children, "")
+	case "FunctionCall", "FunctionDeclaration":
+		output := children[0] + "(" + children[2] + ")"
+		if node.Type == "FunctionDeclaration" {
+			output += " = " + children[5]
+		}
+		return output
+	case "Application":
+		for _, argument := range node.Children[1].Children {
+			children[0] += " " + argument.Source()
+		}
+		return children[0]
+	case "Arguments", "Parameters", "Entries", "Bindings":
+		return strings.Join(children, ", ")
+	case "Line":
+		if comment, ok := node.Get("comment"); ok {
+			return children[0] + " " + comment.(string)
+		}
+		return children[0]
+	case "Piecewise":
+		return strings.Join(children, "; ")
+	case "Sequence":
+		output := children[0]
+		for i := 1; i < len(children); i += 2 {
+			output += children[i] + " " + children[i+1]
+		}
+		return output
+	case "Parameter":
+		if node.Children[1].Type == "Default" {
+			return children[0] + " " + children[1]
+		}
+		if node.Children[1].Type == "Variadic" {
+			return children[0] + "..."
+		}
+		return children[0]
+	case "Fixity":
+		return children[0] + " " + children[1] + " (" + children[3] + ")"
+	case "String":
+		if _, raw := node.Get("raw"); raw {
+			return `"""` + node.Value + `"""`
+		}
+		return `"` + stringEscaper.Replace(node.Value) + `"`
+	case "Multiplication":
+		output := children[0]
+		for i := 1; i < len(children); i += 2 {
+			if children[i] == "" {
+				output += children[i+1]
+			} else {
+				output += " " + children[i] + " " + children[i+1]
+			}
+		}
+		return output
+	case "MapLiteral":
+		return "{" + children[1] + "}"
+	case "MapEntry":
+		return children[0] + ": " + children[2]
+	case "CellRange":
+		return children[0] + ":" + children[1]
+	}
+	if len(node.Children) == 0 {
+		return node.Value
+	}
+	parts := []string{}
+	for _, child := range children {
+		if child != "" {
+			parts = append(parts, child)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// MinimalSource is Source with only the parentheses the meaning needs, so
+// "(1 + 2) * 3" keeps them and "1 + (2 * 3)" loses them.
+func (node *Node) MinimalSource() string {
+	return withoutRedundantParentheses(node.Clone(), false).Source()
+}
+
+// withoutRedundantParentheses unwraps every parenthesized child that binds
+// at least as tightly as its place needs. Arguments of an Application can
+// only be atoms.
+func withoutRedundantParentheses(node *Node, atoms bool) *Node {
+	for i, child := range node.Children {
+		child = withoutRedundantParentheses(child, node.Type == "Application" && i == 1)
+		if child.Type == "Unit" && len(child.Children) == 3 && child.Children[1].Type == "Expression" {
+			inner := child.Children[1].Children[0]
+			needed := operandPrecedence(node, i)
+			if atoms {
+				needed = 7
+			}
+			if needed >= 0 && precedence(inner) >= needed {
+				child = inner
+			}
+		}
+		node.Children[i] = child
+	}
+	return node
+}
+
+// precedence ranks how tightly node binds, from 0 for the loosest.
+func precedence(node *Node) int {
+	switch node.Type {
+	case "Conditional", "Let", "Range":
+		return 0
+	case "Comparison", "ComparisonChain":
+		return 1
+	case "Operator":
+		return 2
+	case "Sum":
+		return 3
+	case "Multiplication":
+		return 4
+	case "Negation", "UnaryPlus", "PrefixUpdate":
+		return 5
+	case "Power":
+		return 6
+	}
+	return 7
+}
+
+// operandPrecedence is the precedence the i-th child of node needs to go
+// without parentheses, or -1 when it keeps them anyway. Right operands
+// need more than left ones, since the operators group to the left, and
+// user operators don't mix without them.
+func operandPrecedence(node *Node, i int) int {
+	switch node.Type {
+	case "Comparison", "ComparisonChain":
+		return 2
+	case "Operator":
+		return 3
+	case "Sum":
+		if i == 0 {
+			return 3
+		}
+		return 4
+	case "Multiplication":
+		// "2(3)" is not "23".
+		if i > 0 && node.Children[i-1].Value == "" {
+			return -1
+		}
+		if i == 0 {
+			return 4
+		}
+		return 5
+	case "Negation", "UnaryPlus":
+		// "-(-x)" is not "--x".
+		return 6
+	case "Power":
+		if i == 0 {
+			return 7
+		}
+		return 6
+	case "FieldAccess":
+		return 7
+	case "PrefixUpdate", "PostfixUpdate":
+		// "(a)++" is an error, which "a++" is not.
+		return -1
+	case "Range":
+		// "(1..2)..3" is not "1..2..3", a range with a step.
+		return -1
+	}
+	return 0
+}
+
+// Simplify rewrites an expression with a few identities, without looking
+// up any variable:
+//
+//	x + 0 → x, x * 1 → x, x * 0 → 0
+//	the numbers of a sum or a product are folded into one
+//	x + x → 2 * x, adding up the terms n * x of the same variable
+//	(x) → x, for a single number or variable
+//
+// Products with a division are left alone, and x * 0 → 0 assumes x is
+// finite. It is not done when a factor updates a variable or calls a
+// function, since those have to run.
+func Simplify(node *Node) *Node {
+	return simplify(node.Clone())
+}
+
+func simplify(node *Node) *Node {
+	if node == nil {
+		return nil
+	}
+	for i, child := range node.Children {
+		node.Children[i] = simplify(child)
+	}
+	switch node.Type {
+	case "Unit":
+		if len(node.Children) == 3 && node.Children[1].Type == "Expression" {
+			inner := node.Children[1].Children[0]
+			if inner.Type == "Number" || inner.Type == "Variable" {
+				return inner
+			}
+		}
+	case "Negation":
+		if value, ok := numberValue(node.Children[1]); ok {
+			return numberNode(-value)
+		}
+	case "Sum":
+		return simplifySum(node)
+	case "Multiplication":
+		return simplifyProduct(node)
+	}
+	return node
+}
+
+func numberValue(node *Node) (float64, bool) {
+	if node.Type != "Number" {
+		return 0, false
+	}
+	if value, ok := node.Get("value"); ok {
+		return value.(float64), true
+	}
+	return parseNumber(node.Value), true
+}
+
+func numberNode(value float64) *Node {
+	node := &Node{Type: "Number", Value: strconv.FormatFloat(value, 'f', -1, 64)}
+	node.Set("value", value)
+	return node
+}
+
+func simplifySum(node *Node) *Node {
+	type term struct {
+		variable    string
+		coefficient float64
+		node        *Node
+	}
+	terms := []*term{}
+	variables := make(map[string]*term)
+	constant := 0.0
+	for i := 0; i < len(node.Children); i += 2 {
+		sign := 1.0
+		if i > 0 && node.Children[i-1].Type == "OpMinus" {
+			sign = -1
+		}
+		child := node.Children[i]
+		name, coefficient := "", sign
+		if value, ok := numberValue(child); ok {
+			constant += sign * value
+			continue
+		} else if child.Type == "Variable" {
+			name = child.Value
+		} else if child.Type == "Multiplication" && len(child.Children) == 3 && child.Children[1].Type == "OpMult" && child.Children[2].Type == "Variable" {
+			if value, ok := numberValue(child.Children[0]); ok {
+				name, coefficient = child.Children[2].Value, sign*value
+			}
+		}
+		if name == "" {
+			terms = append(terms, &term{coefficient: sign, node: child})
+		} else if variables[name] != nil {
+			variables[name].coefficient += coefficient
+		} else {
+			variables[name] = &term{variable: name, coefficient: coefficient}
+			terms = append(terms, variables[name])
+		}
+	}
+	if constant != 0 {
+		terms = append(terms, &term{coefficient: 1, node: numberNode(constant)})
+	}
+	result := &Node{Type: "Sum"}
+	for _, term := range terms {
+		if term.coefficient == 0 {
+			continue
+		}
+		sign := term.coefficient
+		child := term.node
+		if term.variable != "" {
+			child = &Node{Type: "Variable", Value: term.variable}
+			if math.Abs(term.coefficient) != 1 {
+				child = &Node{Type: "Multiplication", Children: []*Node{
+					numberNode(math.Abs(term.coefficient)), {Type: "OpMult", Value: "*"}, child}}
+			}
+		} else if value, ok := numberValue(child); ok {
+			sign = value
+			child = numberNode(math.Abs(value))
+		}
+		if len(result.Children) > 0 {
+			op := &Node{Type: "OpAdd", Value: "+"}
+			if sign < 0 {
+				op = &Node{Type: "OpMinus", Value: "-"}
+			}
+			result.Children = append(result.Children, op, child)
+		} else if sign < 0 {
+			result.Children = append(result.Children, negated(child))
+		} else {
+			result.Children = append(result.Children, child)
+		}
+	}
+	switch len(result.Children) {
+	case 0:
+		return numberNode(0)
+	case 1:
+		return result.Children[0]
+	}
+	return result
+}
+
+func negated(node *Node) *Node {
+	if value, ok := numberValue(node); ok {
+		return numberNode(-value)
+	}
+	if node.Type == "Multiplication" {
+		if value, ok := numberValue(node.Children[0]); ok {
+			node.Children[0] = numberNode(-value)
+			return node
+		}
+	}
+	if node.Type != "Variable" && node.Type != "Number" {
+		node = &Node{Type: "Unit", Children: []*Node{
+			{Type: Char, Value: "("}, {Type: "Expression", Children: []*Node{node}}, {Type: Char, Value: ")"}}}
+	}
+	return &Node{Type: "Negation", Children: []*Node{{Type: "OpMinus", Value: "-"}, node}}
+}
+
+func simplifyProduct(node *Node) *Node {
+	for i := 1; i < len(node.Children); i += 2 {
+		if node.Children[i].Type != "OpMult" {
+			return node
+		}
+	}
+	coefficient := 1.0
+	factors := []*Node{}
+	for i := 0; i < len(node.Children); i += 2 {
+		if value, ok := numberValue(node.Children[i]); ok {
+			coefficient *= value
+		} else {
+			factors = append(factors, node.Children[i])
+		}
+	}
+	if coefficient == 0 {
+		for _, factor := range factors {
+			if hasEffects(factor) {
+				return node
+			}
+		}
+	}
+	if coefficient == 0 || len(factors) == 0 {
+		return numberNode(coefficient)
+	}
+	if coefficient != 1 {
+		factors = append([]*Node{numberNode(coefficient)}, factors...)
+	}
+	if len(factors) == 1 {
+		return factors[0]
+	}
+	result := &Node{Type: "Multiplication", Children: []*Node{factors[0]}}
+	for _, factor := range factors[1:] {
+		result.Children = append(result.Children, &Node{Type: "OpMult", Value: "*"}, factor)
+	}
+	return result
+}
+
+// hasEffects is whether evaluating node can do more than give a value: it
+// has a "++" or "--", or a call that can fail or update a variable.
+func hasEffects(node *Node) bool {
+	switch node.Type {
+	case "PrefixUpdate", "PostfixUpdate", "FunctionCall", "Application":
+		return true
+	}
+	for _, child := range node.Children {
+		if hasEffects(child) {
+			return true
+		}
+	}
+	return false
+}
+
+type Memory struct {
+	Variables map[string]float64
+	Functions map[string]MemoryFunction
+	Options   EvalOptions
+	budget    *int
+	// depth is how many user function calls deep evaluation is.
+	depth int
+	// rationals holds the exact values of variables declared in rational
+	// mode.
+	rationals map[string]*big.Rat
+	// globals are the top-level variables, which functions are declared
+	// among.
+	globals map[string]float64
+}
+
+type EvalOptions struct {
+	Degrees  bool
+	Rational bool
+	// SafeMode refuses to call the built-ins listed in Impure.
+	SafeMode bool
+	// Base prints results in another base, which only works for integers.
+	// Zero means 10.
+	Base int
+	// Epsilon is how far apart the sides of "~=" may be. Zero means
+	// DefaultEpsilon.
+	Epsilon float64
+	// Cells gives the value of a Cell or a CellRange node.
+	Cells func(reference *Node) (float64, error)
+}
+
+const DefaultEpsilon = 1e-9
+
+func FormatValue(value float64, options EvalOptions) (string, error) {
+	if options.Base == 0 || options.Base == 10 {
+		return fmt.Sprint(value), nil
+	}
+	if options.Base < 2 || options.Base > 36 {
+		return "", fmt.Errorf("cannot print in base %d, it must be between 2 and 36", options.Base)
+	}
+	if value != math.Trunc(value) || math.Abs(value) >= 1<<63 {
+		return "", fmt.Errorf("cannot print %v in base %d: not an integer", value, options.Base)
+	}
+	return strconv.FormatInt(int64(value), options.Base), nil
+}
+
+func NewMemory() Memory {
+	variables := make(map[string]float64)
+	return Memory{variables, make(map[string]MemoryFunction), EvalOptions{}, nil, 0, make(map[string]*big.Rat), variables}
+}
+
+// Merge returns a new Memory holding the variables and functions of both,
+// with other's winning where names clash. Options are kept from m.
+func (m Memory) Merge(other Memory) Memory {
+	merged := NewMemory()
+	merged.Options = m.Options
+	for _, memory := range []Memory{m, other} {
+		for name, value := range memory.Variables {
+			merged.Variables[name] = value
+		}
+		for name, function := range memory.Functions {
+			merged.Functions[name] = function
+		}
+		for name, exact := range memory.rationals {
+			merged.rationals[name] = exact
+		}
+	}
+	return merged
+}
+
+var Constants = map[string]float64{"pi": math.Pi}
+
+type Builtin func(arguments []float64, options EvalOptions) float64
+
+var Builtins = map[string]Builtin{
+	"sin":  angle(math.Sin),
+	"cos":  angle(math.Cos),
+	"tan":  angle(math.Tan),
+	"sqrt": unary(math.Sqrt),
+	"rand": func(arguments []float64, options EvalOptions) float64 { return rand.Float64() },
+}
+
+// Impure lists the built-ins that have effects or aren't deterministic.
+var Impure = map[string]bool{"rand": true}
+
+func unary(function func(float64) float64) Builtin {
+	return func(arguments []float64, options EvalOptions) float64 {
+		if len(arguments) != 1 {
+			return math.NaN()
+		}
+		return function(arguments[0])
+	}
+}
+
+func angle(function func(float64) float64) Builtin {
+	return func(arguments []float64, options EvalOptions) float64 {
+		if len(arguments) != 1 {
+			return math.NaN()
+		}
+		if options.Degrees {
+			return function(arguments[0] * math.Pi / 180)
+		}
+		return function(arguments[0])
+	}
+}
+
+// Defaults holds the default of each parameter, or nil for one without. A
+// default is evaluated at each call, after the arguments before it, and
+// sees the top-level variables rather than the caller's.
+//
+// When Variadic is set, the last parameter collects the remaining
+// arguments: inside the body it holds their count, and calling it with an
+// index from 1, or from -1 for the last, gives each of them. That call is
+// a MemoryFunction with Values set. Slicing it, as in xs(2:), gives the
+// count of the values in the slice.
+//
+// Builtin is set instead of Expression when a built-in is passed as an
+// argument, and names it.
+//
+// Applied holds the arguments a partial application such as "add 1" has
+// given already, which come before those of each call.
+type MemoryFunction struct {
+	Parameters []string
+	Expression *Node
+	Defaults   []*Node
+	Variadic   bool
+	Values     []float64
+	Builtin    string
+	Applied    []float64
+}
+
+type FunctionInfo struct {
+	Name       string
+	Parameters []string
+	Arity      int
+}
+
+func (m Memory) ListFunctions() []FunctionInfo {
+	functions := make([]FunctionInfo, 0, len(m.Functions))
+	for name, function := range m.Functions {
+		functions = append(functions, FunctionInfo{name, function.Parameters, len(function.Parameters)})
+	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
+	return functions
+}
+
+func Exec(program *Node) {
+	ExecWith(program, NewMemory())
+}
+
+func ExecWith(program *Node, memory Memory) {
+	for _, node := range program.Children {
+		if err := ExecStatement(node.Children[0], memory); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
+
+// ExecStatement turns a panic while running line into an error, so one bad
+// statement doesn't stop the ones after it.
+func ExecStatement(line *Node, memory Memory) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("internal error: %v", recovered)
+		}
+	}()
+	switch line.Type {
+	case "VariableDeclaration":
+		name := line.Children[0].Value
+		exact, err := exactValue(line.Children[2], memory)
+		if err != nil {
+			return err
+		}
+		if exact != nil {
+			memory.Variables[name], _ = exact.Float64()
+			memory.rationals[name] = exact
+			fmt.Println(name, "=", exact.RatString())
+			return nil
+		}
+		value, err := Eval(line.Children[2], memory)
+		if err != nil {
+			return err
+		}
+		memory.Variables[name] = value
+		delete(memory.rationals, name)
+		formatted, err := FormatValue(value, memory.Options)
+		if err != nil {
+			return err
+		}
+		fmt.Println(name, "=", formatted)
+	case "Expression":
+		if isString(line, memory) {
+			text, err := EvalString(line, memory)
+			if err != nil {
+				return err
+			}
+			fmt.Println(`"` + stringEscaper.Replace(text) + `"`)
+			return nil
+		}
+		exact, err := exactValue(line, memory)
+		if err != nil {
+			return err
+		}
+		if exact != nil {
+			memory.Variables["ans"], _ = exact.Float64()
+			memory.rationals["ans"] = exact
+			fmt.Println(exact.RatString())
+			return nil
+		}
+		value, err := Eval(line, memory)
+		if err != nil {
+			return err
+		}
+		memory.Variables["ans"] = value
+		delete(memory.rationals, "ans")
+		formatted, err := FormatValue(value, memory.Options)
+		if err != nil {
+			return err
+		}
+		fmt.Println(formatted)
+	case "FunctionDeclaration":
+		function, err := DeclaredFunction(line)
+		if err != nil {
+			return err
+		}
+		memory.Functions[line.Children[0].Value] = function
+	case "OperatorDeclaration":
+		function, err := DeclaredFunction(line)
+		if err != nil {
+			return err
+		}
+		memory.Functions[line.Children[1].Value] = function
+	}
+	return nil
+}
+
+// exactValue is the value of node as a fraction when rational output is
+// on and node has one, and nil otherwise.
+func exactValue(node *Node, memory Memory) (*big.Rat, error) {
+	// Exact fractions only print in base 10.
+	if !memory.Options.Rational || (memory.Options.Base != 0 && memory.Options.Base != 10) {
+		return nil, nil
+	}
+	exact, err := EvalRational(node, memory)
+	if err == errInexact {
+		return nil, nil
+	}
+	return exact, err
+}
+
+// EvalStatement is ExecStatement without printing or mutating env: the
+// statement runs against a copy, which is returned. On error env is
+// returned as it was.
+func EvalStatement(node *Node, env Memory) (value float64, newEnv Memory, err error) {
+	if node.Type == "Line" {
+		node = node.Children[0]
+	}
+	newEnv = env.Merge(NewMemory())
+	newEnv.budget = env.budget
+	switch node.Type {
+	case "VariableDeclaration":
+		value, err = Eval(node.Children[2], newEnv)
+		if err != nil {
+			return 0, env, err
+		}
+		newEnv.Variables[node.Children[0].Value] = value
+	case "FunctionDeclaration", "OperatorDeclaration":
+		function, err := DeclaredFunction(node)
+		if err != nil {
+			return 0, env, err
+		}
+		name := node.Children[0].Value
+		if node.Type == "OperatorDeclaration" {
+			name = node.Children[1].Value
+		}
+		newEnv.Functions[name] = function
+	case "Fixity":
+	default:
+		value, err = Eval(node, newEnv)
+		if err != nil {
+			return 0, env, err
+		}
+		newEnv.Variables["ans"] = value
+	}
+	return value, newEnv, nil
+}
+
+// Run evaluates every statement of program, stopping at the first error,
+// and returns the value of the last one, which has to be an expression.
+// Like EvalStatement it leaves env as it was.
+func Run(program *Node, env Memory) (float64, error) {
+	if len(program.Children) == 0 {
+		return 0, fmt.Errorf("the program is empty")
+	}
+	value := 0.0
+	for i, line := range program.Children {
+		var err error
+		value, env, err = EvalStatement(line, env)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	if last := program.Children[len(program.Children)-1].Children[0]; last.Type != "Expression" {
+		return 0, fmt.Errorf("the last statement is a %s, not an expression", last.Type)
+	}
+	return value, nil
+}
+
+// DeclaredFunction also accepts an OperatorDeclaration, whose operands are
+// its two parameters.
+func DeclaredFunction(declaration *Node) (MemoryFunction, error) {
+	if declaration.Type == "OperatorDeclaration" {
+		left, right := declaration.Children[0].Value, declaration.Children[2].Value
+		if left == right {
+			return MemoryFunction{}, fmt.Errorf("duplicate parameter %s in %s", left, declaration.Children[1].Value)
+		}
+		return MemoryFunction{
+			Parameters: []string{left, right},
+			Expression: declaration.Children[4],
+		}, nil
+	}
+	parameters := []string{}
+	defaults := []*Node{}
+	seen := make(map[string]bool)
+	variadic := false
+	for _, parameter := range declaration.Children[2].Children {
+		name := parameter.Children[0].Value
+		if seen[name] {
+			return MemoryFunction{}, fmt.Errorf("duplicate parameter %s in %s", name, declaration.Children[0].Value)
+		}
+		if variadic {
+			return MemoryFunction{}, fmt.Errorf("%s... must be the last parameter of %s", parameters[len(parameters)-1], declaration.Children[0].Value)
+		}
+		seen[name] = true
+		parameters = append(parameters, name)
+		if parameter.Children[1].Type == "Variadic" {
+			variadic = true
+			defaults = append(defaults, nil)
+		} else if parameter.Children[1].Type == "Default" {
+			defaults = append(defaults, parameter.Children[1].Children[1])
+		} else if len(defaults) > 0 && defaults[len(defaults)-1] != nil {
+			return MemoryFunction{}, fmt.Errorf("parameter %s in %s needs a default, since the one before it has one", name, declaration.Children[0].Value)
+		} else {
+			defaults = append(defaults, nil)
+		}
+	}
+	return MemoryFunction{
+		Parameters: parameters,
+		Expression: declaration.Children[5],
+		Defaults:   defaults,
+		Variadic:   variadic,
+	}, nil
+}
+
+// Template reads text with expressions between "{{" and "}}", such as
+// "x is {{ x + 1 }}".
+func Template(input string) (node *Node, rest string, ok bool) {
+	return Some("Template", Or(
+		Regex("Text", regexp.MustCompile(`([^{]|\{[^{])+`)),
+		Then("Hole",
+			Literal("Open", "{{"),
+			Embed("Embedded", Token(Expression)),
+			Token(Literal("Close", "}}")))))(input)
+}
+
+// Blank lines and comments before the first statement are skipped.
+func Program(input string) (node *Node, rest string, ok bool) {
+	return Skipping(optionalSeparators, Some("Lines", Statement))(input)
+}
+
+// A comment at the end of the statement is kept in the "comment"
+// attribute of the Line, so that Source can print it again.
+func Statement(input string) (node *Node, rest string, ok bool) {
+	trailing := ""
+	node, rest, ok = Then("Line",
+		Skipping(WS, Or(
+			Measured("Declaration", Declaration),
+			Measured("Expression", Expression))),
+		Skipping(WithText(WS, func(text string) { trailing = text }), LineDelim))(input)
+	if !ok {
+		return nil, "", false
+	}
+	if comment := strings.TrimSpace(trailing); comment != "" {
+		node.Set("comment", comment)
+	}
+	declareFixity(node)
+	return node, rest, true
+}
+
+// Statements get their Start and End byte offsets into input set, and
+// together they cover input up to the first statement that fails to parse.
+func ParseStatements(input string) []*Node {
+	ResetLimits()
+	ResetOperators()
+	statements := []*Node{}
+	position := 0
+	for {
+		statement, ok := statementAt(input, position)
+		if !ok {
+			return statements
+		}
+		statements = append(statements, statement)
+		position = statement.End
+	}
+}
+
+// prev must come from ParseStatements on an input it consumed entirely, and
+// the edit replaced prev's input[editStart:editEnd] to produce input.
+// Statements past the edit are reused as soon as re-parsing lines up with
+// one of their (shifted) starts, and have their offsets moved in place.
+func ReparseStatements(prev []*Node, input string, editStart, editEnd int) []*Node {
+	ResetLimits()
+	oldLength := 0
+	if len(prev) > 0 {
+		oldLength = prev[len(prev)-1].End
+	}
+	delta := len(input) - oldLength
+
+	first := 0
+	for first < len(prev) && prev[first].End < editStart {
+		first++
+	}
+	statements := append([]*Node{}, prev[:first]...)
+	ResetOperators()
+	for _, statement := range statements {
+		declareFixity(statement)
+	}
+	position := 0
+	if first > 0 {
+		position = prev[first-1].End
+	}
+
+	next := first
+	for {
+		for next < len(prev) && (prev[next].Start < editEnd || prev[next].Start+delta < position) {
+			next++
+		}
+		if next < len(prev) && prev[next].Start+delta == position {
+			for _, statement := range prev[next:] {
+				statement.Start += delta
+				statement.End += delta
+				statements = append(statements, statement)
+			}
+			return statements
+		}
+		statement, ok := statementAt(input, position)
+		if !ok {
+			return statements
+		}
+		statements = append(statements, statement)
+		position = statement.End
+	}
+}
+
+func statementAt(input string, position int) (*Node, bool) {
+	statement, rest, ok := Statement(input[position:])
+	if !ok || len(rest) == len(input)-position {
+		return nil, false
+	}
+	statement.Start = position
+	statement.End = len(input) - len(rest)
+	return statement, true
+}
+
+// CalculatorGrammar mirrors the hand-written calculator rules for
+// documentation; it leaves out the opt-in syntax and the decimal comma.
+func CalculatorGrammar() *Grammar {
+	grammar := &Grammar{Skip: WS}
+	grammar.Define("Program", Repeat("Lines", 0, Ref("Statement")))
+	grammar.Define("Statement", Sequence("Line",
+		Choice(Ref("Declaration"), Ref("Expression")),
+		Pat(Whitespace, `(\r?\n|;)*`)))
+	grammar.Define("Declaration", Choice(
+		Ref("VariableDeclaration"), Ref("FunctionDeclaration"), Ref("FixityDeclaration"), Ref("OperatorDeclaration")))
+	grammar.Define("FixityDeclaration", Sequence("Fixity",
+		Choice(Lit("infixl"), Lit("infixr"), Lit("infix")), Pat("Precedence", `[0-9]`),
+		Lit("("), Ref("OperatorSymbol"), Lit(")")))
+	grammar.Define("OperatorDeclaration", Sequence("OperatorDeclaration",
+		Ref("Variable"), Ref("OperatorSymbol"), Ref("Variable"), Lit("="), Ref("Expression")))
+	grammar.Define("OperatorSymbol", Pat("OpUser", `[!#$%&*+./<=>?@^|~-]+`))
+	grammar.Define("VariableDeclaration", Sequence("VariableDeclaration",
+		Ref("Variable"), Lit("="), Ref("Expression")))
+	grammar.Define("FunctionDeclaration", Sequence("FunctionDeclaration",
+		Ref("Variable"), Lit("("),
+		Repeat("Parameters", 0, Sequence("Parameter",
+			Ref("Variable"),
+			Optional(Choice(Sequence("Default", Lit("="), Ref("Expression")), Tag("Variadic", Lit("...")))),
+			Optional(Lit(",")))),
+		Lit(")"), Lit("="), Ref("FunctionBody")))
+	grammar.Define("FunctionBody", Choice(
+		Sequence("Piecewise",
+			Ref("Guard"),
+			Repeat("Clauses", 0, Sequence("Clause", Lit(";"), Ref("Guard"))),
+			Optional(Sequence("Clause", Lit(";"), Ref("Expression"), Lit("otherwise")))),
+		Ref("Expression")))
+	grammar.Define("Guard", Sequence("Guard", Ref("Expression"), Lit("when"), Ref("Expression")))
+	grammar.Define("Expression", Tag("Expression", Choice(Ref("Conditional"), Ref("Let"), Ref("Range"))))
+	grammar.Define("Let", Sequence("Let",
+		Lit("let"),
+		Sequence("Bindings",
+			Ref("Binding"),
+			Repeat("Bindings", 0, Sequence("Bindings", Lit(","), Ref("Binding")))),
+		Lit("in"), Ref("Expression")))
+	grammar.Define("Binding", Sequence("Binding", Ref("Variable"), Lit("="), Ref("Expression")))
+	grammar.Define("Conditional", Sequence("Conditional",
+		Lit("if"), Ref("Expression"), Lit("then"), Ref("Expression"), Lit("else"), Ref("Expression")))
+	grammar.Define("Range", Sequence("Range",
+		Ref("Comparison"),
+		Optional(Sequence("Bound", Lit(".."), Ref("Comparison"))),
+		Optional(Sequence("Step", Lit(".."), Ref("Comparison")))))
+	grammar.Define("Comparison", Sequence("Comparison",
+		Ref("Operators"),
+		Optional(Sequence("Comparison",
+			Choice(Lit("<="), Lit(">="), Lit("=="), Lit("!="), Lit("~="), Lit("<"), Lit(">")),
+			Ref("Operators")))))
+	grammar.Define("Operators", Sequence("Operator",
+		Ref("Sum"),
+		Repeat("Operands", 0, Sequence("Operand", Ref("OperatorSymbol"), Ref("Sum")))))
+	grammar.Define("Sum", Sequence("Sum",
+		Ref("Multiplication"),
+		Repeat("Terms", 0, Sequence("Term",
+			Choice(Tag("OpAdd", Lit("+")), Tag("OpMinus", Lit("-"))),
+			Ref("Multiplication")))))
+	grammar.Define("Multiplication", Sequence("Multiplication",
+		Ref("Negation"),
+		Repeat("Terms", 0, Sequence("Term",
+			Choice(Tag("OpMult", Lit("*")), Tag("OpFloorDiv", Lit("//")), Tag("OpDiv", Lit("/"))),
+			Ref("Negation")))))
+	grammar.Define("Negation", Choice(
+		Sequence("PrefixUpdate", Choice(Tag("OpIncrement", Lit("++")), Tag("OpDecrement", Lit("--"))), Ref("Postfix")),
+		Sequence("Negation", Tag("OpMinus", Lit("-")), Ref("Negation")),
+		Sequence("UnaryPlus", Tag("OpAdd", Lit("+")), Ref("Negation")),
+		Ref("Power")))
+	grammar.Define("Power", Sequence("Power",
+		Ref("Postfix"),
+		Optional(Sequence("Exponent",
+			Choice(Tag("OpPow", Lit("**")), Tag("OpPow", Lit("^"))),
+			Ref("Negation")))))
+	grammar.Define("Postfix", Sequence("Postfix",
+		Ref("Unit"),
+		Repeat("Fields", 0, Choice(
+			Sequence("FieldAccess", Lit("."), Ref("Variable")),
+			Tag("OpIncrement", Lit("++")),
+			Tag("OpDecrement", Lit("--"))))))
+	grammar.Define("Unit", Choice(
+		Sequence("Unit",
+			Lit("("),
+			Sequence("Sequence", Ref("Expression"), Repeat("Sequence", 0, Sequence("Sequence", Lit(","), Ref("Expression")))),
+			Lit(")")),
+		Sequence("Abs", Lit("|"), Ref("Expression"), Lit("|")),
+		Ref("MapLiteral"),
+		Pat("String", `"([^"\\]|\\.)*"`),
+		Ref("Boolean"),
+		Ref("Slice"),
+		Ref("FunctionCall"),
+		Ref("Variable"),
+		Ref("Number")))
+	grammar.Define("FunctionCall", Sequence("FunctionCall",
+		Ref("Variable"), Lit("("),
+		Repeat("Separators", 0, Lit(",")),
+		Optional(Sequence("Arguments",
+			Ref("Expression"),
+			Repeat("Arguments", 0, Sequence("Argument", Repeat("Separators", 1, Lit(",")), Ref("Expression"))),
+			Repeat("Separators", 0, Lit(",")))),
+		Lit(")")))
+	grammar.Define("Slice", Sequence("Slice",
+		Ref("Variable"), Lit("("), Optional(Ref("Expression")), Lit(":"), Optional(Ref("Expression")), Lit(")")))
+	grammar.Define("MapLiteral", Sequence("MapLiteral",
+		Lit("{"),
+		Optional(Sequence("Entries",
+			Ref("MapEntry"),
+			Repeat("Entries", 0, Sequence("Entry", Lit(","), Ref("MapEntry"))),
+			Optional(Lit(",")))),
+		Lit("}")))
+	grammar.Define("MapEntry", Sequence("MapEntry", Ref("Variable"), Lit(":"), Ref("Expression")))
+	grammar.Define("Boolean", Choice(Tag("Boolean", Lit("true")), Tag("Boolean", Lit("false"))))
+	grammar.Define("Variable", Pat("Variable", `[a-zA-Z][a-zA-Z0-9]*`))
+	grammar.Define("Number", Choice(
+		Pat("Number", `[0-9](_?[0-9])*(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9]+)?`),
+		Tag("Number", Lit("inf")), Tag("Number", Lit("nan"))))
+	return grammar
+}
+
+// On failure, rest is the input Program stalled at rather than "".
+func StrictProgram(input string) (node *Node, rest string, ok bool) {
+	ResetLimits()
+	ResetOperators()
+	node, rest, ok = Program(input)
+	if !ok {
+		return nil, input, false
+	}
+	if _, _, atEnd := EOF(rest); !atEnd {
+		expect(rest, "end of input")
+		return nil, rest, false
+	}
+	return node, rest, true
+}
+
+func Declaration(input string) (node *Node, rest string, ok bool) {
+	return Or(
+		VariableDeclaration,
+		FunctionDeclaration,
+		FixityDeclaration,
+		OperatorDeclaration,
 	)(input)
 }
 
@@ -291,74 +3427,783 @@ func FunctionDeclaration(input string) (node *Node, rest string, ok bool) {
 		Character('('),
 		Some("Parameters", ThenSkipping("Parameter", WS,
 			Variable,
+			Or(ThenSkipping("Default", WS, Character('='), Expression), Literal("Variadic", "..."), Nothing),
 			ArguementDelimeter,
 			)),
 		Character(')'),
 		Character('='),
+		FunctionBody)(input)
+}
+
+// FunctionBody is an expression or a piecewise definition, with clauses
+// separated by ';' such as "0 when x < 0; x otherwise". A ';' is only
+// taken as part of the body when a clause follows it, so a plain body
+// ends the statement as before.
+func FunctionBody(input string) (node *Node, rest string, ok bool) {
+	clause, rest, ok := Clause(input)
+	if !ok {
+		return nil, "", false
+	}
+	if clause.Type != "Guard" {
+		return clause, rest, true
+	}
+	node = &Node{Type: "Piecewise", Children: []*Node{clause}}
+	for clause.Type == "Guard" {
+		_, separatorRest, separatorOk := Skipping(WS, Character(';'))(rest)
+		if !separatorOk {
+			break
+		}
+		next, nextRest, nextOk := Skipping(WS, Clause)(separatorRest)
+		if !nextOk || next.Type != "Guard" && next.Type != "Otherwise" {
+			break
+		}
+		node.Children = append(node.Children, next)
+		clause, rest = next, nextRest
+	}
+	return node, rest, true
+}
+
+// Clause is "value when condition", "value otherwise" or just an
+// expression.
+func Clause(input string) (node *Node, rest string, ok bool) {
+	value, rest, ok := Expression(input)
+	if !ok {
+		return nil, "", false
+	}
+	if when, whenRest, whenOk := Skipping(WS, Keyword("When", "when"))(rest); whenOk {
+		condition, conditionRest, conditionOk := Skipping(WS, Expression)(whenRest)
+		if !conditionOk {
+			return nil, "", false
+		}
+		return &Node{Type: "Guard", Children: []*Node{value, when, condition}}, conditionRest, true
+	}
+	if otherwise, otherwiseRest, otherwiseOk := Skipping(WS, Keyword("Otherwise", "otherwise"))(rest); otherwiseOk {
+		return &Node{Type: "Otherwise", Children: []*Node{value, otherwise}}, otherwiseRest, true
+	}
+	return value, rest, true
+}
+
+// Operator is a user-defined infix operator. Operators are declared with
+// "infixl 6 (<>)" and defined with "a <> b = ...". They bind more loosely
+// than every built-in operator, and among themselves by Precedence.
+type Operator struct {
+	Precedence    int
+	Associativity string
+}
+
+// Operators is filled in while parsing, so a fixity declaration applies to
+// the lines after it. Statement adds to it only once the declaration's line
+// is parsed, and Parse, StrictProgram and ParseStatements start it empty,
+// so declarations don't outlive the parse they were read in.
+var Operators = map[string]Operator{}
+
+func ResetOperators() {
+	Operators = map[string]Operator{}
+}
+
+// declareFixity adds the operator of line to Operators if line is a fixity
+// declaration.
+func declareFixity(line *Node) {
+	if fixity := line.Children[0]; fixity.Type == "Fixity" {
+		precedence, _ := strconv.Atoi(fixity.Children[1].Value)
+		Operators[fixity.Children[3].Value] = Operator{precedence, fixity.Children[0].Value}
+	}
+}
+
+var builtinOperators = map[string]bool{"+": true, "-": true, "*": true, "/": true, "^": true, "**": true, "=": true, "..": true, "//": true,
+	"<": true, "<=": true, ">": true, ">=": true, "==": true, "!=": true, "~=": true}
+
+func FixityDeclaration(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("Fixity", WS,
+		Or(Keyword("Associativity", "infixl"), Keyword("Associativity", "infixr"), Keyword("Associativity", "infix")),
+		Digits("Precedence", 1),
+		Character('('),
+		OperatorSymbol,
+		Character(')'))(input)
+}
+
+func OperatorDeclaration(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("OperatorDeclaration", WS,
+		Variable,
+		OperatorSymbol,
+		Variable,
+		Character('='),
 		Expression)(input)
 }
 
+func OperatorSymbol(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = operatorSymbol(input)
+	if !ok || builtinOperators[node.Value] {
+		return nil, "", false
+	}
+	return node, rest, true
+}
+
 func Expression(input string) (node *Node, rest string, ok bool) {
-	return As("Expression", Sum)(input)
+	return As("Expression", Or(Conditional, Let, Range))(input)
+}
+
+// Let is "let x = 2, y = x + 1 in x * y". Each binding can see the ones
+// before it, and none outlive the expression.
+func Let(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("Let", WS,
+		Keyword("Let", "let"),
+		Satisfy(
+			SepBy("Bindings",
+				ThenSkipping("Binding", WS, Variable, Character('='), Expression),
+				Skipping(WS, ArgumentSeparator)),
+			func(bindings *Node) bool { return len(bindings.Children) > 0 }),
+		Keyword("In", "in"),
+		Expression)(input)
+}
+
+// Conditional is "if c then a else b". The else branch takes the rest of
+// the expression, as a lambda body would.
+func Conditional(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("Conditional", WS,
+		Keyword("If", "if"),
+		Expression,
+		Keyword("Then", "then"),
+		Expression,
+		Keyword("Else", "else"),
+		Expression)(input)
+}
+
+// Range is "1..5" or, with a step, "1..10..2". Anything else is passed
+// through as is.
+func Range(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = Comparison(input)
+	if !ok {
+		return nil, "", false
+	}
+	children := []*Node{node}
+	for len(children) < 5 {
+		dots, dotsRest, dotsOk := Skipping(WS, Literal("OpRange", ".."))(rest)
+		if !dotsOk {
+			break
+		}
+		bound, boundRest, boundOk := Skipping(WS, Comparison)(dotsRest)
+		if !boundOk {
+			break
+		}
+		children = append(children, dots, bound)
+		rest = boundRest
+	}
+	if len(children) == 1 {
+		return node, rest, true
+	}
+	return &Node{Type: "Range", Children: children}, rest, true
+}
+
+// ChainedComparisons reads "a < b < c" as "a < b and b < c", with b
+// evaluated once, instead of stopping after "a < b".
+var ChainedComparisons = false
+
+// Comparison is 1 when it holds and 0 when it doesn't. It doesn't chain,
+// so "a < b < c" stops after "a < b", unless ChainedComparisons is set.
+func Comparison(input string) (node *Node, rest string, ok bool) {
+	operand := func(input string) (*Node, string, bool) {
+		return OperatorExpression(input, 0)
+	}
+	if ChainedComparisons {
+		node, rest, ok = Interleave("ComparisonChain", Skipping(WS, operand), Skipping(WS, comparisonOperator))(input)
+		if ok && node.Type == "ComparisonChain" && len(node.Children) == 3 {
+			node.Type = "Comparison"
+		}
+		return node, rest, ok
+	}
+	return Trailing("Comparison", WS, operand, comparisonOperator, operand)(input)
+}
+
+var comparisonOperator = Or(
+	Literal("OpLessEqual", "<="),
+	Literal("OpGreaterEqual", ">="),
+	Literal("OpEqual", "=="),
+	Literal("OpNotEqual", "!="),
+	Literal("OpApprox", "~="),
+	Literal("OpLess", "<"),
+	Literal("OpGreater", ">"))
+
+// OperatorExpression parses user operators of at least minPrecedence by
+// precedence climbing, with Sum as the operand.
+func OperatorExpression(input string, minPrecedence int) (node *Node, rest string, ok bool) {
+	node, rest, ok = Sum(input)
+	if !ok || len(Operators) == 0 {
+		return node, rest, ok
+	}
+	for {
+		symbol, symbolRest, symbolOk := Skipping(WS, OperatorSymbol)(rest)
+		if !symbolOk {
+			return node, rest, true
+		}
+		operator, declared := Operators[symbol.Value]
+		if !declared || operator.Precedence < minPrecedence {
+			return node, rest, true
+		}
+		next := operator.Precedence + 1
+		if operator.Associativity == "infixr" {
+			next = operator.Precedence
+		}
+		right, rightRest, rightOk := OperatorExpression(symbolRest, next)
+		if !rightOk {
+			return node, rest, true
+		}
+		node = &Node{Type: "Operator", Children: []*Node{node, {Type: "OpUser", Value: symbol.Value}, right}}
+		rest = rightRest
+		if operator.Associativity == "infix" {
+			minPrecedence = operator.Precedence + 1
+		}
+	}
 }
 
 func Sum(input string) (node *Node, rest string, ok bool) {
-	return Or(
-		ThenSkipping("Sum", WS,
-			Multiplication, 
-			AtLeast("Terms", 1, ThenSkipping("Term", WS,
-				Or(As("OpAdd", Character('+')), As("OpMinus", Character('-'))),
-				Multiplication))),
-		Skipping(WS, Multiplication))(input)
+	return Interleave("Sum",
+		Token(Multiplication),
+		Token(Or(Literal("OpAdd", "+"), Literal("OpMinus", "-"))))(input)
 }
 
 func Multiplication(input string) (node *Node, rest string, ok bool) {
+	return Interleave("Multiplication",
+		Token(Negation),
+		Token(Or(Literal("OpMult", "*"), Literal("OpFloorDiv", "//"), Literal("OpDiv", "/"))))(input)
+}
+
+func Negation(input string) (node *Node, rest string, ok bool) {
 	return Or(
-		ThenSkipping("Multiplication", WS,
-			Unit,
-			AtLeast("Terms", 1, ThenSkipping("Term", WS,
-				Or(As("OpMult", Character('*')), As("OpDiv", Character('/'))),
-				Unit))),
-		Skipping(WS, Unit))(input)
+		Skipping(WS, Then("PrefixUpdate", updateOperator, Postfix)),
+		ThenSkipping("Negation", WS,
+			Literal("OpMinus", "-"),
+			Negation),
+		ThenSkipping("UnaryPlus", WS,
+			Literal("OpAdd", "+"),
+			Negation),
+		Skipping(WS, ImplicitMultiplication),
+		Skipping(WS, Power))(input)
+}
+
+// ImplicitMultiplication reads "2x", "2f(x)" and "2(x + 1)" as products. The
+// factor has to follow the number directly, so "2 x" is not one, and "2e3"
+// is already taken by Number. "0xff" isn't "0 * xff" either, but a hex
+// number missing its exponent.
+func ImplicitMultiplication(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = Then("Multiplication",
+		Number,
+		Literal("OpMult", ""),
+		implicitFactor)(input)
+	if ok && node.Children[0].Value == "0" && (input[1] == 'x' || input[1] == 'X') {
+		return missed(input)
+	}
+	return node, rest, ok
 }
 
+func implicitFactor(input string) (node *Node, rest string, ok bool) {
+	if input == "" || !(unicode.IsLetter(rune(input[0])) || input[0] == '(' || input[0] == '`') {
+		return nil, "", false
+	}
+	return Power(input)
+}
+
+// "**" is tried before Multiplication can read it as two "*".
+func Power(input string) (node *Node, rest string, ok bool) {
+	return Trailing("Power", WS,
+		Postfix,
+		Or(Literal("OpPow", "**"), Literal("OpPow", "^")),
+		Negation)(input)
+}
+
+func Postfix(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = Unit(input)
+	if !ok {
+		return nil, "", false
+	}
+	for {
+		if update, updateRest, updateOk := postfixUpdateOperator(rest); updateOk {
+			node = &Node{Type: "PostfixUpdate", Children: []*Node{node, update}}
+			rest = updateRest
+			continue
+		}
+		field, fieldRest, fieldOk := ThenSkipping("FieldAccess", WS, Character('.'), Identifier)(rest)
+		if !fieldOk {
+			return node, rest, true
+		}
+		node = &Node{Type: "FieldAccess", Children: append([]*Node{node}, field.Children...)}
+		rest = fieldRest
+	}
+}
+
+// "++" and "--" have to touch their variable, and "a - -b" still subtracts.
+var updateOperator = Or(Literal("OpIncrement", "++"), Literal("OpDecrement", "--"))
+
+// A postfix "++" or "--" can't have an operand after it, so "x--3" keeps
+// meaning x - (-3) and "x++ y" x + (+y).
+var postfixUpdateOperator = NotFollowedBy(updateOperator, Skipping(WS, Regex("Operand", regexp.MustCompile("[0-9A-Za-z(|{\"`]"))))
+
+var Juxtaposition = false
+
 func Unit(input string) (node *Node, rest string, ok bool) {
+	if Juxtaposition {
+		return Or(Skipping(WS, Application), Atom)(input)
+	}
+	return Atom(input)
+}
+
+// Application binds tighter than any operator and is curried, so "f x y"
+// is "(f x) y", which for an f of two parameters is "f(x, y)". A partly
+// applied "f x" can be passed to a parameter, and "inc inc 2" applies inc
+// to inc and then the result to 2, which is an error because a number
+// can't be applied.
+//
+// A name directly followed by "(" is a FunctionCall instead, so that
+// "f(x, y)" still passes two arguments.
+func Application(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("Application", WS,
+		NotFollowedBy(Variable, Character('(')),
+		AtLeast("Arguments", 1, Skipping(WS, Atom)))(input)
+}
+
+func Atom(input string) (node *Node, rest string, ok bool) {
 	return Or(
 		ThenSkipping("Unit", WS,
 			Character('('),
+			Interleave("Sequence", Skipping(WS, Expression), Skipping(WS, ArgumentSeparator)),
+			Expect(Character(')'), "a closing parenthesis")),
+		// The inner expression stops at the first "|" it can't use, so
+		// "||x| + |y||" nests the way it reads.
+		ThenSkipping("Abs", WS,
+			Character('|'),
 			Expression,
-			Character(')')),
-		Skipping(WS, FunctionCall),
-		Skipping(WS, Variable),
-		Skipping(WS, Number))(input)
+			Expect(Character('|'), "a closing '|'")),
+		Token(MapLiteral),
+		Token(RawString),
+		Token(StringLiteral),
+		Token(Boolean),
+		Token(CellReference),
+		Token(FunctionCall),
+		Token(Label("a variable", NotFollowedBy(Variable, Skipping(WS, Character('('))))),
+		Token(Label("a number", Number)))(input)
+}
+
+// CellReferences reads names such as "A1" and "$B$2", and ranges such as
+// "A1:A3", as references to spreadsheet cells instead of variables.
+var CellReferences = false
+
+// CellReference is a Cell, or a CellRange of two Cells separated by ':'.
+func CellReference(input string) (node *Node, rest string, ok bool) {
+	if !CellReferences {
+		return nil, "", false
+	}
+	node, rest, ok = Cell(input)
+	if !ok {
+		return nil, "", false
+	}
+	to, toRest, toOk := Prefixed(Character(':'), Cell)(rest)
+	if !toOk {
+		return node, rest, true
+	}
+	return &Node{Type: "CellRange", Children: []*Node{node, to}}, toRest, true
+}
+
+var cellParts = regexp.MustCompile(`^(\$?)([A-Z]+)(\$?)([0-9]+)`)
+
+// Cell keeps the reference as written in Value, and its parts in the
+// "column" (string), "row" (int), "absoluteColumn" and "absoluteRow"
+// (bool) attributes.
+func Cell(input string) (node *Node, rest string, ok bool) {
+	if step() {
+		return nil, "", false
+	}
+	parts := cellParts.FindStringSubmatch(input)
+	if parts == nil || continuesWord(input[len(parts[0]):]) {
+		return missed(input)
+	}
+	row, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return missed(input)
+	}
+	if allocate() {
+		return nil, "", false
+	}
+	node = &Node{Type: "Cell", Value: parts[0]}
+	node.Set("column", parts[2])
+	node.Set("row", row)
+	node.Set("absoluteColumn", parts[1] == "$")
+	node.Set("absoluteRow", parts[3] == "$")
+	return node, input[len(parts[0]):], true
+}
+
+func MapLiteral(input string) (node *Node, rest string, ok bool) {
+	return ThenSkipping("MapLiteral", WS,
+		Character('{'),
+		SepBy("Entries",
+			ThenSkipping("MapEntry", WS, Variable, Character(':'), Expression),
+			Skipping(WS, Character(','))),
+		Or(Character(','), Nothing),
+		Character('}'))(input)
 }
 
+// FunctionCall also parses slices like "xs(1:3)", since telling the two
+// apart only after the first argument avoids parsing it twice.
 func FunctionCall(input string) (node *Node, rest string, ok bool) {
-	return ThenSkipping("FunctionCall", WS,
+	node, rest, ok = ThenSkipping("FunctionCall", WS,
 		Variable,
 		Character('('),
-		Some("Arguments", ThenSkipping("Argument", WS,
+		SepByTolerant("Arguments", SliceRange, Skipping(WS, ArgumentSeparator)),
+		Expect(Character(')'), "a closing parenthesis"))(input)
+	if !ok {
+		return nil, "", false
+	}
+	arguments := node.Children[2].Children
+	for _, argument := range arguments {
+		if argument.Type == "SliceRange" && len(arguments) > 1 {
+			return nil, "", false
+		}
+	}
+	if len(arguments) == 1 && arguments[0].Type == "SliceRange" {
+		slice := arguments[0].Children
+		node = &Node{Type: "Slice", Children: []*Node{node.Children[0], node.Children[1], slice[0], slice[1], slice[2], node.Children[3]}}
+	}
+	return node, rest, true
+}
+
+// SliceRange gives back a plain Expression when no ':' follows it, so call
+// arguments need not try Expression again after it fails.
+func SliceRange(input string) (node *Node, rest string, ok bool) {
+	return Or(
+		Trailing("SliceRange", WS,
 			Expression,
-			ArguementDelimeter,
-			)),
-		Character(')'))(input)
+			Character(':'),
+			Or(Expression, Nothing)),
+		ThenSkipping("SliceRange", WS,
+			Nothing,
+			Character(':'),
+			Or(Expression, Nothing)))(input)
+}
+
+// A string can't be followed by a quote, so an unterminated RawString is
+// not read as an empty string.
+var StringLiteral = NotFollowedBy(Quoted("String", '"', '\\'), Character('"'))
+
+// RawString is a String between triple quotes, which can span lines and
+// has no escapes. It is marked with the "raw" attribute.
+func RawString(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = Raw("String", `"""`)(input)
+	if ok {
+		node.Set("raw", true)
+	}
+	return node, rest, ok
+}
+
+func Boolean(input string) (node *Node, rest string, ok bool) {
+	return Or(
+		Keyword("Boolean", "true"),
+		Keyword("Boolean", "false"))(input)
+}
+
+func Variable(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = Identifier(input)
+	if ok && (Keywords[node.Value] || CaseInsensitiveKeywords && Keywords[strings.ToLower(node.Value)]) {
+		return nil, "", false
+	}
+	if !ok {
+		return QuotedIdentifier(input)
+	}
+	return node, rest, ok
+}
+
+func QuotedIdentifier(input string) (node *Node, rest string, ok bool) {
+	node, rest, ok = quotedIdentifier(input)
+	if !ok {
+		return nil, "", false
+	}
+	name := node.Value[1 : len(node.Value)-1]
+	return &Node{Type: "Variable", Value: strings.ReplaceAll(name, "``", "`")}, rest, true
+}
+
+var Keywords = map[string]bool{"true": true, "false": true, "if": true, "then": true, "else": true, "let": true, "in": true, "when": true, "otherwise": true, "inf": true, "nan": true}
+
+// DecimalComma switches Number to "3,14" and, so that the two can't be
+// confused, arguments to being separated by ';'.
+var DecimalComma = false
+
+// Number stores the parsed float64 as its "value" attribute so Eval
+// doesn't have to parse the literal again every time it runs. The words
+// inf and nan are numbers too; "-inf" is the negation of inf.
+func Number(input string) (node *Node, rest string, ok bool) {
+	parse := pointNumber
+	if DecimalComma {
+		parse = commaNumber
+	}
+	node, rest, ok = Or(parse, Keyword("Number", "inf"), Keyword("Number", "nan"))(input)
+	if ok {
+		node.Set("value", parseNumber(node.Value))
+	}
+	return node, rest, ok
+}
+
+// NumberWithUnit reads a Number followed by one of units, as in "10px",
+// and keeps the unit in the "unit" attribute of the Number. A suffix that
+// runs on into a longer identifier, as "s" in "10sec", is not a unit and
+// is left unread.
+func NumberWithUnit(units... string) Parser {
+	sorted := append([]string{}, units...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	return func(input string) (node *Node, rest string, ok bool) {
+		if step() {
+			return nil, "", false
+		}
+		node, rest, ok = Number(input)
+		if !ok {
+			return nil, "", false
+		}
+		for _, unit := range sorted {
+			if !strings.HasPrefix(rest, unit) {
+				continue
+			}
+			after := rest[len(unit):]
+			if after != "" && isIdentifierByte(unit[len(unit)-1]) && isIdentifierByte(after[0]) {
+				continue
+			}
+			node.Set("unit", unit)
+			return node, after, true
+		}
+		return node, rest, true
+	}
+}
+
+func isIdentifierByte(chr byte) bool {
+	return chr == '_' || unicode.IsLetter(rune(chr)) || unicode.IsDigit(rune(chr))
+}
+
+var numberCleaner = strings.NewReplacer("_", "", ",", ".")
+
+func parseNumber(literal string) float64 {
+	number, _ := strconv.ParseFloat(numberCleaner.Replace(literal), 64)
+	return number
+}
+
+// RequireSeparators rejects statements run together on one line, such as
+// "a = 1 b = 2"; only the last statement may go without a separator.
+var RequireSeparators = false
+
+func LineDelim(input string) (node *Node, rest string, ok bool) {
+	if !RequireSeparators {
+		return optionalSeparators(input)
+	}
+	if _, _, atEnd := EOF(input); atEnd {
+		return &Node{Type: Whitespace}, input, true
+	}
+	return Label("a newline or ';'", separators)(input)
+}
+
+func ArgumentSeparator(input string) (node *Node, rest string, ok bool) {
+	if DecimalComma {
+		return semicolonDelimeter(input)
+	}
+	return commaDelimeter(input)
+}
+
+// Only the last argument may go without a delimiter. Letting any of them
+// omit it made "f(f(f(..." take exponential time to reject.
+func ArguementDelimeter(input string) (node *Node, rest string, ok bool) {
+	if node, rest, ok = ArgumentSeparator(input); ok {
+		return node, rest, ok
+	}
+	if _, _, closing := Skipping(WS, Character(')'))(input); closing {
+		return &Node{Type: "ArgumentDelimeter"}, input, true
+	}
+	return nil, "", false
+}
+
+var Identifier = Regex("Variable", regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9]*`))
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+var operatorSymbol = Regex("OpUser", regexp.MustCompile(`[!#$%&*+./<=>?@^|~-]+`))
+var plainIdentifier = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*$`)
+var quotedIdentifier = Regex("Variable", regexp.MustCompile("`([^`]|``)+`"))
+// An underscore in a number can only stand between two digits.
+var pointNumber = Regex("Number", regexp.MustCompile(`(0[xX]([0-9a-fA-F](_?[0-9a-fA-F])*(\.([0-9a-fA-F](_?[0-9a-fA-F])*)?)?|\.[0-9a-fA-F](_?[0-9a-fA-F])*)[pP][+-]?[0-9]+|[0-9](_?[0-9])*(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9]+)?)`))
+var commaNumber = Regex("Number", regexp.MustCompile(`(0[xX]([0-9a-fA-F](_?[0-9a-fA-F])*(\.([0-9a-fA-F](_?[0-9a-fA-F])*)?)?|\.[0-9a-fA-F](_?[0-9a-fA-F])*)[pP][+-]?[0-9]+|[0-9](_?[0-9])*(,[0-9](_?[0-9])*)?([eE][+-]?[0-9]+)?)`))
+var commaDelimeter = Regex("ArgumentDelimeter", regexp.MustCompile(`,`))
+var semicolonDelimeter = Regex("ArgumentDelimeter", regexp.MustCompile(`;`))
+
+func WS(input string) (node *Node, rest string, ok bool) {
+	return Trivia(input)
+}
+
+// SetCommentPrefix makes comments start with prefix instead of "#". A
+// prefix that ';' or a built-in operator could be read as is rejected,
+// except for "//", which takes the place of floor division.
+func SetCommentPrefix(prefix string) error {
+	if prefix == "" || strings.ContainsAny(prefix, " \t\r\n") {
+		return fmt.Errorf("the comment prefix %q is empty or holds whitespace", prefix)
+	}
+	if strings.Contains(prefix, ";") {
+		return fmt.Errorf("the comment prefix %q clashes with the separator ';'", prefix)
+	}
+	if prefix != "//" {
+		operators := []string{}
+		for operator := range builtinOperators {
+			operators = append(operators, operator)
+		}
+		sort.Strings(operators)
+		for _, operator := range operators {
+			if strings.HasPrefix(operator, prefix) || strings.HasPrefix(prefix, operator) {
+				return fmt.Errorf("the comment prefix %q clashes with the operator %s", prefix, operator)
+			}
+		}
+	}
+	Trivia = SpacesAndComments(prefix)
+	return nil
+}
+
+var separator = Regex(Whitespace, regexp.MustCompile(`\r?\n|;`))
+
+// Separators take comments and blank lines after them along, so a line
+// holding only a comment doesn't end the program.
+func optionalSeparators(input string) (node *Node, rest string, ok bool) {
+	return Some(Whitespace, Or(separator, WS))(input)
+}
+
+func separators(input string) (node *Node, rest string, ok bool) {
+	return Then(Whitespace, separator, optionalSeparators)(input)
+}
+
+// Tokenize splits input into the tokens the calculator grammar is made
+// of, for debugging. The parser doesn't use it: it reads characters
+// directly. Each token has its Type, Value, Start and End set.
+func Tokenize(input string) ([]*Node, *ParseError) {
+	lexers := []Parser{
+		Regex("Separator", regexp.MustCompile(`\r?\n|;`)),
+		Number,
+		RawString,
+		StringLiteral,
+		Identifier,
+		QuotedIdentifier,
+		Regex("Operator", regexp.MustCompile(`[!#$%&*+./<=>?@^|~-]+`)),
+		Regex("Punctuation", regexp.MustCompile(`[(),\[\]{}:]`)),
+	}
+	tokens := []*Node{}
+	rest := input
+	for {
+		_, rest, _ = Trivia(rest)
+		if rest == "" {
+			return tokens, nil
+		}
+		start := len(input) - len(rest)
+		var token *Node
+		for _, lexer := range lexers {
+			if node, lexerRest, ok := lexer(rest); ok && lexerRest != rest {
+				token, rest = node, lexerRest
+				break
+			}
+		}
+		if token == nil {
+			return tokens, &ParseError{Offset: start, Message: fmt.Sprintf("unexpected character %q", rest[0])}
+		}
+		if token.Type == "Variable" && Keywords[token.Value] {
+			token.Type = "Keyword"
+		}
+		token.Value = input[start : len(input)-len(rest)]
+		token.Start, token.End = start, len(input)-len(rest)
+		tokens = append(tokens, token)
+	}
 }
 
-var Number = Regex("Number", regexp.MustCompile("-?[0-9]+"))
-var Variable = Regex("Variable", regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9]*`))
-var ArguementDelimeter = Regex("ArgumentDelimeter", regexp.MustCompile(`,?`))
-var WS = Regex(Whitespace, regexp.MustCompile(` *`))
-var LineDelim = Regex(Whitespace, regexp.MustCompile(`[\n;]*`))
+// PrintTokens writes the tokens of input to w, one per line with its offset
+// and type, followed by the diagnostic of the first byte Tokenize can't
+// read, if any. name is the file the diagnostic names.
+func PrintTokens(w io.Writer, name string, input string) {
+	tokens, err := Tokenize(input)
+	for _, token := range tokens {
+		fmt.Fprintf(w, "%d\t%s\t%q\n", token.Start, token.Type, token.Value)
+	}
+	if err != nil {
+		fmt.Fprintln(w, FormatDiagnostic(name, err, input))
+	}
+}
 
 func main() {
+	flag.BoolVar(&MeasurementsEnabled, "measure", false, "print bytes consumed per top-level rule")
+	flag.BoolVar(&Juxtaposition, "juxtaposition", false, "apply functions to arguments written after them, as in \"f x y\"")
+	flag.BoolVar(&DecimalComma, "decimal-comma", false, "write decimals as \"3,14\" and separate arguments with ';'")
+	degrees := flag.Bool("degrees", false, "take trigonometric arguments in degrees")
+	ebnf := flag.Bool("ebnf", false, "print the calculator grammar as EBNF and exit")
+	tokens := flag.Bool("tokens", false, "print the tokens of the input and exit")
+	rational := flag.Bool("rational", false, "print exact fractions where possible")
+	flag.IntVar(&StepLimit, "max-steps", 0, "fail parses that take more than this many combinator calls")
+	flag.IntVar(&NodeLimit, "max-nodes", 0, "fail parses that allocate more than this many nodes")
+	flag.BoolVar(&RequireSeparators, "require-separators", false, "require a newline or ';' between statements")
+	commentPrefix := flag.String("comment-prefix", "#", "start comments with this instead of \"#\"")
+	flag.BoolVar(&CellReferences, "cells", false, "read names such as A1, $B$2 and A1:A3 as cell references")
+	flag.BoolVar(&ChainedComparisons, "chain-comparisons", false, "read \"a < b < c\" as \"a < b and b < c\"")
+	flag.BoolVar(&CaseInsensitiveKeywords, "case-insensitive-keywords", false, "match keywords such as true and false in any case")
+	strict := flag.Bool("strict", false, "fail unless the whole input is parsed")
+	safe := flag.Bool("safe", false, "refuse to call built-ins with effects or random results")
+	base := flag.Int("base", 10, "print integer results in this base")
+	epsilon := flag.Float64("epsilon", DefaultEpsilon, "how far apart the sides of \"~=\" may be")
+	flag.Parse()
+	if err := SetCommentPrefix(*commentPrefix); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	if *ebnf {
+		fmt.Print(CalculatorGrammar().EBNF())
+		return
+	}
 	input, _ := ioutil.ReadAll(os.Stdin)
-	node, rest, ok := Program(string(input))
-	if ok { 
+	if *tokens {
+		PrintTokens(os.Stdout, "<stdin>", string(input))
+		return
+	}
+	parse := Program
+	if *strict {
+		parse = StrictProgram
+	}
+	node, rest, err := Parse(parse, string(input))
+	if err == nil {
 		fmt.Println("Unprocessed:", "\"" + rest + "\"")
 		fmt.Println("Ast:", node)
 		fmt.Println("---------------- OUTPUT -------------")
-		Exec(node)
+		memory := NewMemory()
+		memory.Options.Degrees = *degrees
+		memory.Options.Rational = *rational
+		memory.Options.SafeMode = *safe
+		memory.Options.Base = *base
+		memory.Options.Epsilon = *epsilon
+		ExecWith(node, memory)
+		if MeasurementsEnabled {
+			fmt.Println("---------------- MEASUREMENTS -------")
+			measured := Measurements()
+			labels := []string{}
+			for label := range measured {
+				labels = append(labels, label)
+			}
+			sort.Strings(labels)
+			for _, label := range labels {
+				fmt.Println(label, "calls:", measured[label].Calls, "bytes:", measured[label].Bytes)
+			}
+		}
 	} else {
-		fmt.Println("Parser Failed")
+		fmt.Println(FormatDiagnostic("<stdin>", err, string(input)))
+	}
+}
+
+// TypedInteger parses sums and differences of integers straight to an
+// int, without building a Node tree.
+func TypedInteger(input string) (value int, rest string, ok bool) {
+	integer := Typed(Token(Regex("Integer", regexp.MustCompile(`[0-9]+`))), func(node *Node) int {
+		n, _ := strconv.Atoi(node.Value)
+		return n
+	})
+	sign := func(symbol byte, factor int) TypedParser[int] {
+		return Typed(Token(Character(symbol)), func(*Node) int { return factor })
+	}
+	term := ThenT(OrT(sign('+', 1), sign('-', -1)), integer,
+		func(factor, n int) int { return factor * n })
+	var terms TypedParser[int]
+	terms = func(input string) (int, string, bool) {
+		return OrT(
+			ThenT(term, terms, func(a, b int) int { return a + b }),
+			func(input string) (int, string, bool) { return 0, input, true })(input)
 	}
+	return ThenT(integer, terms, func(a, b int) int { return a + b })(input)
 }
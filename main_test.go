@@ -0,0 +1,1433 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var digits = regexp.MustCompile(`[0-9]*`)
+
+func parse(t *testing.T, parser Parser, input string) *Node {
+	t.Helper()
+	node, rest, err := Parse(parser, input)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", input, err)
+	}
+	if rest != "" {
+		t.Fatalf("parsing %q left %q", input, rest)
+	}
+	return node
+}
+
+func evaluate(t *testing.T, node *Node, memory Memory) float64 {
+	t.Helper()
+	result, err := Eval(node, memory)
+	if err != nil {
+		t.Fatalf("evaluating %v: %v", node, err)
+	}
+	return result
+}
+
+func run(t *testing.T, input string) (float64, error) {
+	t.Helper()
+	return Run(parse(t, Program, input), NewMemory())
+}
+
+func value(t *testing.T, input string) float64 {
+	t.Helper()
+	return evaluate(t, parse(t, Expression, input), NewMemory())
+}
+
+func TestHexFloatsAndGrouping(t *testing.T) {
+	for input, want := range map[string]float64{
+		"0x1.8p3":     12,
+		"0x1_0p0":     16,
+		"1_000.000_5": 1000.0005,
+		"1_000":       1000,
+	} {
+		if got := value(t, input); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	for _, input := range []string{"1_", "1__0", "0x_p0", "1_.5", "0x1_p0"} {
+		if _, rest, _ := Parse(Expression, input); rest == "" {
+			t.Errorf("%s parsed as a number", input)
+		}
+	}
+}
+
+func TestMeasured(t *testing.T) {
+	MeasurementsEnabled = true
+	defer func() { MeasurementsEnabled = false }()
+	ResetMeasurements()
+	parse(t, Program, "x = 12\n1 + 2")
+	measured := Measurements()
+	if got := measured["Declaration"]; got.Bytes != len("x = 12") {
+		t.Errorf("Declaration consumed %d bytes, want %d", got.Bytes, len("x = 12"))
+	}
+	if got := measured["Expression"]; got.Bytes != len("1 + 2") {
+		t.Errorf("Expression consumed %d bytes, want %d", got.Bytes, len("1 + 2"))
+	}
+}
+
+func TestBooleans(t *testing.T) {
+	if value(t, "true") != 1 || value(t, "false") != 0 {
+		t.Error("true and false should be 1 and 0")
+	}
+	memory := NewMemory()
+	memory.Variables["trueVar"] = 1
+	if got := evaluate(t, parse(t, Expression, "trueVar + 1"), memory); got != 2 {
+		t.Errorf("trueVar + 1 = %v, want 2", got)
+	}
+}
+
+func TestStrictProgram(t *testing.T) {
+	if _, _, ok := StrictProgram("1 + 2\nx = 3"); !ok {
+		t.Error("a fully consumed program failed")
+	}
+	if _, rest, ok := StrictProgram("1 + 2\n)"); ok || rest != ")" {
+		t.Errorf("trailing garbage gave %v, stalling at %q", ok, rest)
+	}
+}
+
+func TestQuotedIdentifier(t *testing.T) {
+	for input, name := range map[string]string{"`my var`": "my var", "`true`": "true", "`a``b`": "a`b"} {
+		if node := parse(t, Variable, input); node.Value != name {
+			t.Errorf("%s is named %q, want %q", input, node.Value, name)
+		}
+	}
+	memory := NewMemory()
+	memory.Variables["my var"] = 2
+	if got := evaluate(t, parse(t, Expression, "`my var` * 3"), memory); got != 6 {
+		t.Errorf("`my var` * 3 = %v, want 6", got)
+	}
+}
+
+func TestGrammarSkip(t *testing.T) {
+	grammar := &Grammar{Skip: WS}
+	pair := grammar.Seq("Pair", Character('('), Digit, Character(','), Digit, Character(')'))
+	node := parse(t, grammar.Many("Pairs", pair), "(1 ,  2)  ( 3,4 )")
+	if len(node.Children) != 2 || node.Children[0].Children[3].Value != "2" || node.Children[1].Children[1].Value != "3" {
+		t.Errorf("got %v", node)
+	}
+}
+
+func TestPowers(t *testing.T) {
+	for input, want := range map[string]float64{
+		"2 ^ -1":    0.5,
+		"4 ^ 0.5":   2,
+		"8 ^ (1/3)": 2,
+		"-2 ^ 2":    -4,
+	} {
+		if got := value(t, input); math.Abs(got-want) > 1e-12 {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if node := parse(t, Expression, "-2 ^ 2"); node.Children[0].Type != "Negation" {
+		t.Errorf("-2 ^ 2 parsed as %v", node)
+	}
+}
+
+func TestReparseStatements(t *testing.T) {
+	prev := ParseStatements("a = 1\nb = 2\nc = 3\n")
+	if len(prev) != 3 {
+		t.Fatalf("got %d statements, want 3", len(prev))
+	}
+	first, second, third := prev[0], prev[1], prev[2]
+	edited := "a = 1\nb = 20\nc = 3\n"
+	statements := ReparseStatements(prev, edited, len("a = 1\nb = 2"), len("a = 1\nb = 2"))
+	if len(statements) != 3 {
+		t.Fatalf("got %d statements, want 3", len(statements))
+	}
+	if statements[0] != first || statements[2] != third {
+		t.Error("the unedited statements were not reused")
+	}
+	if statements[1] == second || !strings.Contains(statements[1].String(), "20") {
+		t.Errorf("the edited statement is %v", statements[1])
+	}
+	if third.Start != len("a = 1\nb = 20\n") || third.End != len(edited) {
+		t.Errorf("the third statement spans %d to %d", third.Start, third.End)
+	}
+}
+
+func TestEOL(t *testing.T) {
+	if _, rest, ok := EOL("\nx"); !ok || rest != "x" {
+		t.Error("EOL should match a newline")
+	}
+	if _, rest, ok := EOL(""); !ok || rest != "" {
+		t.Error("EOL should match the end of input")
+	}
+	if _, _, ok := EOL("x\n"); ok {
+		t.Error("EOL should fail in the middle of a line")
+	}
+}
+
+func TestLabel(t *testing.T) {
+	_, _, err := Parse(Then("Pair", Label("a digit", Digit), Label("another digit", Digit)), "1x")
+	if err == nil || !strings.Contains(err.Error(), "another digit") {
+		t.Errorf("got %v, want the label in the error", err)
+	}
+}
+
+func enable(t *testing.T, option *bool) {
+	old := *option
+	*option = true
+	t.Cleanup(func() { *option = old })
+}
+
+func TestJuxtaposition(t *testing.T) {
+	enable(t, &Juxtaposition)
+	memory := NewMemory()
+	memory.Variables["x"] = 4
+	memory.Functions["inc"] = MemoryFunction{Parameters: []string{"x"}, Expression: parse(t, Expression, "x + 1")}
+	memory.Functions["add"] = MemoryFunction{Parameters: []string{"a", "b"}, Expression: parse(t, Expression, "a + b")}
+	for input, want := range map[string]float64{"inc 2": 3, "inc x * 2": 10, "add 1 2": 3} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	for _, input := range []string{"inc inc 2", "add 1"} {
+		if _, err := Eval(parse(t, Expression, input), memory); err == nil {
+			t.Errorf("%s should be an error", input)
+		}
+	}
+	const definitions = "add(a, b) = a + b\nadder(a) = add a\napply(f, x) = f(x)\n"
+	for input, want := range map[string]float64{
+		"add(1, 2)":         3,
+		"adder 1 2":         3,
+		"apply(add 10, 5)":  15,
+		"apply (adder 1) 4": 5,
+		"apply(adder 1, 4)": 5,
+	} {
+		got, err := run(t, definitions+input)
+		if err != nil || got != want {
+			t.Errorf("%s = %v, %v, want %v", input, got, err, want)
+		}
+	}
+	if _, err := run(t, definitions+"apply (add 1 2) 4"); err == nil {
+		t.Error("applying a number should be an error")
+	}
+}
+
+func TestDecimalComma(t *testing.T) {
+	enable(t, &DecimalComma)
+	memory := NewMemory()
+	memory.Functions["f"] = MemoryFunction{Parameters: []string{"a", "b"}, Expression: parse(t, Expression, "a * b")}
+	if got := evaluate(t, parse(t, Expression, "f(1,5; 2)"), memory); got != 3 {
+		t.Errorf("f(1,5; 2) = %v, want 3", got)
+	}
+	if got := value(t, "0,25 + 1"); got != 1.25 {
+		t.Errorf("0,25 + 1 = %v, want 1.25", got)
+	}
+}
+
+func TestFreeVariables(t *testing.T) {
+	reads, writes := parse(t, Program, "y = x + 1\nf(a) = a * z\nw = f(y)").FreeVariables()
+	if strings.Join(reads, " ") != "x z y" {
+		t.Errorf("reads = %v, want [x z y]", reads)
+	}
+	if strings.Join(writes, " ") != "y w" {
+		t.Errorf("writes = %v, want [y w]", writes)
+	}
+}
+
+func TestDeepNesting(t *testing.T) {
+	for _, input := range []string{strings.Repeat("(", 40) + "1", strings.Repeat("f(", 40)} {
+		if _, _, err := Parse(StrictProgram, input); err == nil {
+			t.Errorf("%q parsed", input)
+		}
+	}
+}
+
+func TestLongInput(t *testing.T) {
+	if _, _, err := Parse(StrictProgram, strings.Repeat("-", 20000)); err == nil {
+		t.Error("a run of minus signs parsed")
+	}
+}
+
+func TestRegexAtLeast(t *testing.T) {
+	parser := RegexAtLeast("Digits", 1, digits)
+	if _, _, ok := parser("abc"); ok {
+		t.Error("a zero-length match was accepted")
+	}
+	if node, rest, ok := parser("123abc"); !ok || node.Value != "123" || rest != "abc" {
+		t.Errorf("got %v %q %v", node, rest, ok)
+	}
+}
+
+func TestDegrees(t *testing.T) {
+	memory := NewMemory()
+	memory.Options.Degrees = true
+	if got := evaluate(t, parse(t, Expression, "sin(90)"), memory); math.Abs(got-1) > 1e-12 {
+		t.Errorf("sin(90) in degrees = %v", got)
+	}
+	if got := value(t, "sin(pi/2)"); math.Abs(got-1) > 1e-12 {
+		t.Errorf("sin(pi/2) = %v", got)
+	}
+}
+
+func TestFieldAccess(t *testing.T) {
+	node := parse(t, Expression, "p.x").Children[0]
+	if node.Type != "FieldAccess" || node.Children[0].Value != "p" || node.Children[2].Value != "x" {
+		t.Errorf("got %v", node)
+	}
+	memory := NewMemory()
+	memory.Variables["p"] = 1
+	if _, err := Eval(node, memory); err == nil || !strings.Contains(err.Error(), "cannot read field x: p is not a record") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDigits(t *testing.T) {
+	if node, rest, ok := Digits("Year", 4)("2024"); !ok || node.Value != "2024" || rest != "" {
+		t.Errorf("exactly four digits gave %v %q %v", node, rest, ok)
+	}
+	if _, _, ok := Digits("Year", 4)("202"); ok {
+		t.Error("too few digits matched")
+	}
+	if node, rest, ok := Digits("Month", 2)("123"); !ok || node.Value != "12" || rest != "3" {
+		t.Errorf("trailing digits gave %v %q %v", node, rest, ok)
+	}
+}
+
+func TestEBNF(t *testing.T) {
+	grammar := &Grammar{Skip: WS}
+	grammar.Define("List", Sequence("List", Lit("["), Repeat("Items", 0, Ref("Item")), Lit("]")))
+	grammar.Define("Item", Choice(Pat("Number", `[0-9]+`), Tag("Boolean", Lit("true"))))
+	if got := grammar.EBNF(); got != "List = \"[\" { Item } \"]\" ;\nItem = ? /[0-9]+/ ? | \"true\" ;\n" {
+		t.Errorf("got %q", got)
+	}
+	if node := parse(t, grammar.Parser("List"), "[1 true 23]"); len(node.Children[1].Children) != 3 {
+		t.Errorf("got %v", node)
+	}
+	calculator := CalculatorGrammar()
+	for _, rule := range []string{"Program =", "Expression =", "Number ="} {
+		if !strings.Contains(calculator.EBNF(), rule) {
+			t.Errorf("the calculator EBNF has no %q", rule)
+		}
+	}
+	parse(t, calculator.Parser("Program"), "x = 1 + 2\nf(a) = a * x")
+}
+
+func TestArgumentErrors(t *testing.T) {
+	memory := NewMemory()
+	memory.Functions["f"] = MemoryFunction{Parameters: []string{"a", "b"}, Expression: parse(t, Expression, "a + b")}
+	_, err := Eval(parse(t, Expression, "f(1, y)"), memory)
+	if err == nil || !strings.Contains(err.Error(), "argument 2 of f") || !strings.Contains(err.Error(), "undefined variable y") {
+		t.Errorf("got %v, want it to name argument 2 and y", err)
+	}
+}
+
+func TestFormatDiagnostic(t *testing.T) {
+	err := &ParseError{Offset: 8, Expected: []string{"a number"}}
+	if got := FormatDiagnostic("calc.txt", err, "x = 1\ny = +"); got != "calc.txt:2:3: expected a number" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRational(t *testing.T) {
+	memory := NewMemory()
+	memory.Options.Rational = true
+	exact, err := EvalRational(parse(t, Expression, "1/3 * 3 + 2 ^ -2"), memory)
+	if err != nil || exact.RatString() != "5/4" {
+		t.Errorf("rational 1/3 * 3 + 2 ^ -2 = %v, %v", exact, err)
+	}
+	if _, err := EvalRational(parse(t, Expression, "2 ^ 0.5"), memory); err != errInexact {
+		t.Errorf("2 ^ 0.5 gave %v, want errInexact", err)
+	}
+	if got := value(t, "1/3 * 3"); got != 1.0/3*3 {
+		t.Errorf("float 1/3 * 3 = %v", got)
+	}
+	ExecWith(parse(t, Program, "a = 1/10"), memory)
+	if exact, err := EvalRational(parse(t, Expression, "a * 3"), memory); err != nil || exact.RatString() != "3/10" {
+		t.Errorf("rational a * 3 = %v, %v", exact, err)
+	}
+	ExecWith(parse(t, Program, "a = sqrt(2)"), memory)
+	if _, err := EvalRational(parse(t, Expression, "a"), memory); err != errInexact {
+		t.Errorf("a = sqrt(2) gave %v, want errInexact", err)
+	}
+}
+
+func TestMapLiteral(t *testing.T) {
+	for input, entries := range map[string]int{"{}": 0, "{a: 1}": 1, "{a: 1, b: 2}": 2, "{a: 1, b: 2,}": 2} {
+		node := parse(t, MapLiteral, input)
+		if got := len(node.Children[1].Children); got != entries {
+			t.Errorf("%s has %d entries, want %d", input, got, entries)
+		}
+	}
+	if _, err := Eval(parse(t, Expression, "{a: 1}"), NewMemory()); err == nil {
+		t.Error("evaluating a map should be an error")
+	}
+}
+
+func TestAttrs(t *testing.T) {
+	node := &Node{Type: "Number", Value: "1"}
+	node.Set("type", "int")
+	if got, ok := node.Get("type"); !ok || got != "int" {
+		t.Errorf("Get gave %v, %v", got, ok)
+	}
+	clone := node.Clone()
+	clone.Set("type", "float")
+	if got, _ := node.Get("type"); got != "int" {
+		t.Error("setting an attribute on the clone changed the original")
+	}
+	if !node.Equal(clone) {
+		t.Error("Equal should ignore attributes")
+	}
+	if node.Equal(&Node{Type: "Number", Value: "2"}) {
+		t.Error("nodes with different values are equal")
+	}
+}
+
+func TestSlices(t *testing.T) {
+	for _, input := range []string{"xs(1:3)", "xs(:3)", "xs(1:)", "xs(:)"} {
+		if node := parse(t, Expression, input).Children[0]; node.Type != "Slice" || len(node.Children) != 6 {
+			t.Errorf("%s parsed as %v", input, node)
+		}
+	}
+	if node := parse(t, Expression, "xs(-1)").Children[0]; node.Type != "FunctionCall" {
+		t.Errorf("xs(-1) parsed as %v", node)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	node := parse(t, Expression, "1 + 2 - 3").Children[0]
+	values := []string{}
+	for i, child := range node.Children {
+		if i%2 == 1 {
+			values = append(values, string(child.Type))
+		} else {
+			values = append(values, child.Value)
+		}
+	}
+	if node.Type != "Sum" || strings.Join(values, " ") != "1 OpAdd 2 OpMinus 3" {
+		t.Errorf("got %v with children %v", node.Type, values)
+	}
+	if node := parse(t, Expression, "4").Children[0]; node.Type != "Number" {
+		t.Errorf("a lone operand was wrapped in %v", node.Type)
+	}
+	if got := value(t, "2 * 3 / 4 + 1 - 0.5"); got != 2 {
+		t.Errorf("2 * 3 / 4 + 1 - 0.5 = %v, want 2", got)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	if _, rest, ok := EOL("\r\nx"); !ok || rest != "x" {
+		t.Error("EOL should match CRLF")
+	}
+	lf := parse(t, StrictProgram, "a = 1\nb = a + 1\nb * 2\n")
+	crlf := parse(t, StrictProgram, "a = 1\r\nb = a + 1\r\nb * 2\r\n")
+	if len(crlf.Children) != 3 || len(crlf.Children) != len(lf.Children) {
+		t.Errorf("LF gave %d statements and CRLF %d", len(lf.Children), len(crlf.Children))
+	}
+	for i, line := range crlf.Children {
+		if !line.Children[0].Equal(lf.Children[i].Children[0]) {
+			t.Errorf("statement %d differs: %v", i+1, line)
+		}
+	}
+}
+
+func TestNumberValue(t *testing.T) {
+	for literal, want := range map[string]float64{"3.25": 3.25, "1_000": 1000, "0x1.8p3": 12} {
+		node := parse(t, Number, literal)
+		if cached, _ := node.Get("value"); cached != want {
+			t.Errorf("%s has value %v, want %v", literal, cached, want)
+		}
+	}
+	literal := &Node{Type: "Number", Value: "2.5"}
+	if got := evaluate(t, literal, NewMemory()); got != 2.5 {
+		t.Errorf("a node without a cached value gave %v, want 2.5", got)
+	}
+}
+
+func BenchmarkNumber(b *testing.B) {
+	node, _, _ := Expression("1.5 * 2.25 + 3_000")
+	memory := NewMemory()
+	for i := 0; i < b.N; i++ {
+		Eval(node, memory)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	StepLimit = 500
+	defer func() { StepLimit = 0 }()
+	_, _, err := Parse(Program, strings.Repeat("(", 100)+"1"+strings.Repeat(")", 100))
+	if err == nil || err.Message != "step limit exceeded" {
+		t.Errorf("got %v, want the step limit to be exceeded", err)
+	}
+	if _, _, err := Parse(Program, "1 + 2"); err != nil {
+		t.Errorf("a small program failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := len(ParseStatements("x = 1\ny = 2")); got != 2 {
+			t.Errorf("call %d gave %d statements, want 2", i+1, got)
+		}
+	}
+}
+
+func TestConcurrentParses(t *testing.T) {
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			Expression("1 + 2 * (x")
+		}()
+	}
+	group.Wait()
+}
+
+func TestRequireSeparators(t *testing.T) {
+	enable(t, &RequireSeparators)
+	if _, _, err := Parse(StrictProgram, "a = 1 b = 2"); err == nil {
+		t.Error("statements run together were accepted")
+	}
+	if _, _, err := Parse(StrictProgram, "a = 1; b = 2\nc = 3"); err != nil {
+		t.Errorf("separated statements failed: %v", err)
+	}
+}
+
+func TestQuoted(t *testing.T) {
+	single := Quoted("String", '\'', '\\')
+	if node, rest, ok := single("'abc' x"); !ok || node.Value != "abc" || rest != " x" {
+		t.Errorf("got %v %q %v", node, rest, ok)
+	}
+	if node, _, ok := single(`'it\'s'`); !ok || node.Value != "it's" {
+		t.Errorf("got %v %v", node, ok)
+	}
+	if _, _, ok := single("'abc"); ok {
+		t.Error("an unterminated string matched")
+	}
+	if node, _, ok := Quoted("String", '"', '"')(`"say ""hi"""`); !ok || node.Value != `say "hi"` {
+		t.Errorf("a doubled quote gave %v %v", node, ok)
+	}
+}
+
+func TestEvalBatch(t *testing.T) {
+	env := NewMemory()
+	env.Variables["x"] = 2
+	results, errs := EvalBatch([]string{"x + 1", "y", "x * 10", "x 1"}, env)
+	if errs[0] != nil || errs[2] != nil || results[0] != 3 || results[2] != 20 {
+		t.Errorf("got %v, %v", results, errs)
+	}
+	if errs[1] == nil {
+		t.Error("the undefined variable gave no error")
+	}
+	if errs[3] == nil {
+		t.Error("trailing input gave no error")
+	}
+	EvalBatch([]string{"x++"}, env)
+	if env.Variables["x"] != 2 {
+		t.Error("x++ changed env")
+	}
+}
+
+func TestUnaryPlus(t *testing.T) {
+	memory := NewMemory()
+	memory.Variables["x"] = 5
+	for input, want := range map[string]float64{"+5": 5, "+x": 5, "3 + +2": 5, "-+2": -2} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%q = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestDuplicateParameters(t *testing.T) {
+	if _, err := DeclaredFunction(parse(t, FunctionDeclaration, "f(x, x) = x + 1")); err == nil || !strings.Contains(err.Error(), "duplicate parameter x") {
+		t.Errorf("got %v", err)
+	}
+	function, err := DeclaredFunction(parse(t, FunctionDeclaration, "f(x, y) = x + y"))
+	if err != nil || strings.Join(function.Parameters, " ") != "x y" {
+		t.Errorf("got %v, %v", function.Parameters, err)
+	}
+}
+
+func TestAns(t *testing.T) {
+	memory := NewMemory()
+	ExecWith(parse(t, Program, "2 + 3\nans * 2\nx = 7"), memory)
+	if memory.Variables["ans"] != 10 {
+		t.Errorf("ans = %v, want 10", memory.Variables["ans"])
+	}
+}
+
+func TestSepByTolerant(t *testing.T) {
+	for _, input := range []string{"f(1,,2)", "f(,1,2,)", "f(1, 2)"} {
+		node := parse(t, Expression, input).Children[0]
+		if got := len(node.Children[2].Children); got != 2 {
+			t.Errorf("%s has %d arguments, want 2", input, got)
+		}
+	}
+	if node, rest, ok := SepByTolerant("List", Digit, Character(','))("1,,2,x"); !ok || len(node.Children) != 2 || rest != "x" {
+		t.Errorf("got %v %q %v", node, rest, ok)
+	}
+}
+
+func TestCaseInsensitiveKeywords(t *testing.T) {
+	enable(t, &CaseInsensitiveKeywords)
+	for _, input := range []string{"SELECT", "select", "Select"} {
+		if _, _, ok := Keyword("Select", "select")(input); !ok {
+			t.Errorf("%s didn't match the keyword", input)
+		}
+	}
+	if got := value(t, "TRUE + False"); got != 1 {
+		t.Errorf("TRUE + False = %v, want 1", got)
+	}
+	memory := NewMemory()
+	ExecWith(parse(t, Program, "Foo = 1\nfoo = 2"), memory)
+	if memory.Variables["Foo"] != 1 || memory.Variables["foo"] != 2 {
+		t.Errorf("Foo and foo were not distinct: %v", memory.Variables)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := NewMemory(), NewMemory()
+	a.Variables["x"], a.Variables["y"] = 1, 2
+	b.Variables["x"] = 10
+	a.Functions["f"] = MemoryFunction{Parameters: []string{"a"}}
+	b.Functions["f"] = MemoryFunction{Parameters: []string{"a", "b"}}
+	a.Options.Degrees = true
+	merged := a.Merge(b)
+	if merged.Variables["x"] != 10 || merged.Variables["y"] != 2 {
+		t.Errorf("got variables %v", merged.Variables)
+	}
+	if len(merged.Functions["f"].Parameters) != 2 {
+		t.Error("other's function didn't win")
+	}
+	if !merged.Options.Degrees {
+		t.Error("m's options were not kept")
+	}
+	if a.Variables["x"] != 1 {
+		t.Error("Merge changed m")
+	}
+}
+
+func TestSatisfy(t *testing.T) {
+	octet := Satisfy(Regex("Number", digits), func(node *Node) bool {
+		n, _ := strconv.Atoi(node.Value)
+		return n <= 255
+	})
+	if _, rest, ok := octet("200.1"); !ok || rest != ".1" {
+		t.Errorf("200 gave %q %v", rest, ok)
+	}
+	if _, _, ok := octet("300"); ok {
+		t.Error("300 was accepted")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	memory := NewMemory()
+	if err := ExecStatement(parse(t, Expression, "g(1)"), memory); err == nil {
+		t.Error("calling an undefined function gave no error")
+	}
+	if err := ExecStatement(parse(t, Expression, "1 + 1"), memory); err != nil || memory.Variables["ans"] != 2 {
+		t.Errorf("the next statement didn't run: %v", err)
+	}
+	if _, err := run(t, "f(x) = f(x)\nf(1)"); err == nil || !strings.Contains(err.Error(), "too deep") {
+		t.Errorf("runaway recursion gave %v", err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	for _, input := range []string{"2 * 3 + f(1, x)", "`my var` - -x ^ 2", "{a: 1, b: (2 / 3)}", "xs(1:3).y", "f(a, b) = a + b"} {
+		if got := parse(t, Statement, input).Children[0].Source(); got != input {
+			t.Errorf("%q printed back as %q", input, got)
+		}
+	}
+	if got := parse(t, Program, "a = 1;b=a\n\n+b").Source(); got != "a = 1\nb = a\n+b" {
+		t.Errorf("got %q", got)
+	}
+	node := parse(t, Expression, "2 * 3").Children[0]
+	if node.Children[1].Type != "OpMult" || node.Children[1].Value != "*" {
+		t.Errorf("got %v", node.Children[1])
+	}
+}
+
+func TestOperatorNodes(t *testing.T) {
+	if node := parse(t, Expression, "a"); node.Value != "" {
+		t.Errorf("Expression took the value %q of its child", node.Value)
+	}
+	grammar := &Grammar{Skip: WS}
+	grammar.Define("Product", Sequence("Product", Pat("Number", `[0-9]+`), Tag("OpMult", Lit("*")), Pat("Number", `[0-9]+`)))
+	if node := parse(t, grammar.Parser("Product"), "2 * 3"); node.Children[1].Type != "OpMult" || node.Children[1].Value != "*" {
+		t.Errorf("got %v", node.Children[1])
+	}
+}
+
+func TestMixedLine(t *testing.T) {
+	program := parse(t, Program, "a = 1; a + 2; b = a")
+	types := []string{}
+	for _, line := range program.Children {
+		types = append(types, string(line.Children[0].Type))
+	}
+	if strings.Join(types, " ") != "VariableDeclaration Expression VariableDeclaration" {
+		t.Errorf("got %v", types)
+	}
+	memory := NewMemory()
+	ExecWith(program, memory)
+	if memory.Variables["ans"] != 3 || memory.Variables["b"] != 1 {
+		t.Errorf("got ans = %v and b = %v", memory.Variables["ans"], memory.Variables["b"])
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	let := Prefixed(Keyword("Let", "let"), Skipping(WS, VariableDeclaration))
+	if node, rest, ok := let("let a = 1"); !ok || rest != "" || node.Type != "VariableDeclaration" {
+		t.Errorf("let a = 1 gave %v %q %v", node, rest, ok)
+	}
+	for _, input := range []string{"a = 1", "leta = 1"} {
+		if _, _, ok := let(input); ok {
+			t.Errorf("%s parsed", input)
+		}
+	}
+}
+
+func declare(t *testing.T, memory Memory, declaration string) {
+	t.Helper()
+	node := parse(t, FunctionDeclaration, declaration)
+	function, err := DeclaredFunction(node)
+	if err != nil {
+		t.Fatalf("declaring %q: %v", declaration, err)
+	}
+	memory.Functions[node.Children[0].Value] = function
+}
+
+func TestBudget(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "f(x) = f(x) + 1")
+	declare(t, memory, "double(x) = x * 2")
+	if _, err := EvalWithBudget(parse(t, Expression, "f(1)"), memory, 1000); err != ErrBudgetExceeded {
+		t.Errorf("runaway recursion gave %v", err)
+	}
+	if got, err := EvalWithBudget(parse(t, Expression, "double(3) + 1"), memory, 100); err != nil || got != 7 {
+		t.Errorf("double(3) + 1 = %v, %v", got, err)
+	}
+	if _, err := EvalWithBudget(parse(t, Expression, "double(1) + double(2)"), memory, 8); err != ErrBudgetExceeded {
+		t.Errorf("calls did not share the budget: %v", err)
+	}
+}
+
+func TestPowerAliases(t *testing.T) {
+	for _, input := range []string{"2 ** 3", "2 ^ 3", "2**3"} {
+		node := parse(t, Expression, input).Children[0]
+		if node.Type != "Power" || node.Children[1].Type != "OpPow" {
+			t.Errorf("%s parsed as %v", input, node)
+		}
+		if got := value(t, input); got != 8 {
+			t.Errorf("%s = %v, want 8", input, got)
+		}
+	}
+	if got := parse(t, Expression, "2 ** 3").Source(); got != "2 ** 3" {
+		t.Errorf("2 ** 3 printed back as %q", got)
+	}
+}
+
+func TestListFunctions(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "g(a, b) = a + b")
+	declare(t, memory, "f(x) = x")
+	functions := memory.ListFunctions()
+	if len(functions) != 2 || functions[0].Name != "f" || functions[1].Name != "g" {
+		t.Fatalf("got %v", functions)
+	}
+	if functions[1].Arity != 2 || strings.Join(functions[1].Parameters, " ") != "a b" {
+		t.Errorf("g is listed as %v", functions[1])
+	}
+}
+
+func TestImplicitMultiplication(t *testing.T) {
+	memory := NewMemory()
+	memory.Variables["x"] = 3
+	declare(t, memory, "f(a) = a + 1")
+	for input, want := range map[string]float64{"2x": 6, "2(x+1)": 8, "2f(x)": 8, "2e3": 2000, "2x^2": 18} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if got := parse(t, Expression, "2x * 3").Source(); got != "2x * 3" {
+		t.Errorf("2x * 3 printed back as %q", got)
+	}
+	for _, input := range []string{"2 x", "0xff", "0Xff"} {
+		if _, rest, _ := Parse(Expression, input); rest == "" {
+			t.Errorf("%s parsed as a product", input)
+		}
+	}
+	if got := parse(t, Expression, "2x").Children[0].String(); got != "Multiplication[2 x]" {
+		t.Errorf("2x = %s, want Multiplication[2 x]", got)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	block := Block("Block",
+		Keyword("Begin", "begin"),
+		Some("Body", Skipping(WS, Number)),
+		Skipping(WS, Keyword("End", "end")))
+	node := parse(t, block, "begin 1 2 end")
+	if len(node.Children) != 3 || len(node.Children[1].Children) != 2 || node.Children[2].Type != "End" {
+		t.Errorf("got %v", node)
+	}
+	_, _, err := Parse(block, "begin 1 2")
+	if err == nil || err.Offset != 9 || strings.Join(err.Expected, ", ") != "the end of the block" {
+		t.Errorf("got %v, want the end of the block at offset 9", err)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	for input, want := range map[string]float64{`number("3")`: 3, `number("1_000") + 1`: 1001, `number(" 2.5 ")`: 2.5} {
+		if got := value(t, input); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if node := parse(t, StringLiteral, `"a \"b\" \\ c"`); node.Value != `a "b" \ c` || node.Source() != `"a \"b\" \\ c"` {
+		t.Errorf("got %q, printed back as %s", node.Value, node.Source())
+	}
+	text, err := EvalString(parse(t, Expression, "string(3)"), NewMemory())
+	if err != nil || text != "3" {
+		t.Errorf("string(3) = %q, %v", text, err)
+	}
+	if got := value(t, "number(string(2.5)) * 2"); got != 5 {
+		t.Errorf("number(string(2.5)) * 2 = %v", got)
+	}
+	for _, input := range []string{`"3" + 2`, `number("x")`, `number("1", "2")`, "string(3) + 2"} {
+		if _, err := Eval(parse(t, Expression, input), NewMemory()); err == nil {
+			t.Errorf("%s should be an error", input)
+		}
+	}
+	if text, err := EvalString(parse(t, Expression, `"a" + "b" + string(1)`), NewMemory()); err != nil || text != "ab1" {
+		t.Errorf(`"a" + "b" + string(1) = %q, %v`, text, err)
+	}
+	if _, err := EvalString(parse(t, Expression, `"a" + 1`), NewMemory()); err == nil || !strings.Contains(err.Error(), "cannot add 1 to a string") {
+		t.Errorf(`"a" + 1 gave %v`, err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	count := 0
+	input := strings.Repeat("1,", 999) + "1"
+	node := parse(t, ForEach(Digit, Character(','), func(*Node) error {
+		count++
+		return nil
+	}), input)
+	if count != 1000 || len(node.Children) != 0 {
+		t.Errorf("fn ran %d times and the node has %d children", count, len(node.Children))
+	}
+	noSevens := ForEach(Digit, Character(','), func(node *Node) error {
+		if node.Value == "7" {
+			return fmt.Errorf("7 is not allowed")
+		}
+		return nil
+	})
+	_, _, err := Parse(noSevens, "1,2,7,3")
+	if err == nil || err.Offset != 4 || err.Message != "7 is not allowed" {
+		t.Errorf("got %v, want the error at offset 4", err)
+	}
+}
+
+func TestUserOperators(t *testing.T) {
+	declarations := "infixl 6 (<>)\na <> b = a - b\ninfixr 7 (##)\na ## b = a / b\n"
+	for input, want := range map[string]float64{"10 <> 4 ## 2": 8, "10 <> 4 <> 1": 5, "64 ## 8 ## 2": 16} {
+		if got, err := run(t, declarations+input); err != nil || got != want {
+			t.Errorf("%s = %v, %v, want %v", input, got, err, want)
+		}
+	}
+	if _, rest, _ := Parse(Program, "infix 6 (<>)\n1 <> 2 <> 3"); rest == "" {
+		t.Error("a non-associative operator was chained")
+	}
+	if _, rest, _ := Parse(Program, "1 <> 2"); rest == "" {
+		t.Error("a fixity declaration outlived its parse")
+	}
+	enable(t, &RequireSeparators)
+	if _, rest, _ := Parse(Program, "1\ninfixl 6 (<>) 2"); len(Operators) != 0 || rest == "" {
+		t.Errorf("a fixity declaration on a line that failed was kept, leaving %q", rest)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "f(x) = x + 1")
+	if got, err := Eval(parse(t, Expression, "rand()"), memory); err != nil || got < 0 || got >= 1 {
+		t.Errorf("rand() = %v, %v", got, err)
+	}
+	memory.Options.SafeMode = true
+	if _, err := Eval(parse(t, Expression, "rand()"), memory); err == nil || !strings.Contains(err.Error(), "safe mode") {
+		t.Errorf("rand in safe mode gave %v", err)
+	}
+	if got, err := Eval(parse(t, Expression, "sqrt(4) + f(1)"), memory); err != nil || got != 4 {
+		t.Errorf("sqrt(4) + f(1) in safe mode = %v, %v", got, err)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	for input, source := range map[string]string{"1..5": "1..5", "1 .. 10..2": "1..10..2", "a + 1..b": "a + 1 .. b"} {
+		node := parse(t, Expression, input).Children[0]
+		if node.Type != "Range" || node.Source() != source {
+			t.Errorf("%s parsed as %v", input, node)
+		}
+	}
+	if _, err := Eval(parse(t, Expression, "1..5"), NewMemory()); err == nil || !strings.Contains(err.Error(), "lists are not supported") {
+		t.Errorf("evaluating a range gave %v", err)
+	}
+	if _, _, err := Parse(FixityDeclaration, "infixl 6 (..)"); err == nil {
+		t.Error(".. was declared as an operator")
+	}
+}
+
+func TestWithText(t *testing.T) {
+	captured := ""
+	parse(t, Then("Call", WithText(FunctionCall, func(text string) { captured = text }), Literal("Bang", "!")), "f(1, g(2))!")
+	if captured != "f(1, g(2))" {
+		t.Errorf("captured %q", captured)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	for input, want := range map[string]float64{
+		"if -1 then 1 else 2":                 1,
+		"if 0 then 1 else 2":                  2,
+		"if 0/0 then 1 else 2":                2,
+		"if 1 then 2 else missing":            2,
+		"1 + (if 0 then 1 else 2 + 3)":        6,
+		"if 1 then if 0 then 1 else 2 else 3": 2,
+	} {
+		if got := value(t, input); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestNotFollowedBy(t *testing.T) {
+	variable := NotFollowedBy(Variable, Character('('))
+	if _, _, ok := variable("foo"); !ok {
+		t.Error("foo didn't match")
+	}
+	if _, _, ok := variable("foo("); ok {
+		t.Error("foo( matched")
+	}
+	if _, rest, err := Parse(Expression, "f(1"); err == nil {
+		t.Errorf("an unfinished call parsed as a variable, leaving %q", rest)
+	}
+}
+
+func TestLet(t *testing.T) {
+	for input, want := range map[string]float64{"let x = 2 in x * 3": 6, "let x = 2, y = x + 1 in x * y": 6} {
+		if got := value(t, input); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	memory := NewMemory()
+	ExecWith(parse(t, Program, "z = let x = 2 in x"), memory)
+	if _, leaked := memory.Variables["x"]; leaked || memory.Variables["z"] != 2 {
+		t.Errorf("got variables %v", memory.Variables)
+	}
+	reads, _ := parse(t, Expression, "let x = y in x + z").FreeVariables()
+	if strings.Join(reads, " ") != "y z" {
+		t.Errorf("reads = %v, want [y z]", reads)
+	}
+}
+
+func TestLastFailureOffset(t *testing.T) {
+	if _, _, err := Parse(Program, "1 + * 2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := LastFailureOffset(); got != len("1 + ") {
+		t.Errorf("1 + * 2 failed at %d, want 4", got)
+	}
+	ResetFailureTracking("ab")
+	if got := LastFailureOffset(); got != -1 {
+		t.Errorf("got %d after a reset, want -1", got)
+	}
+	Then("Pair", Character('a'), Character('c'))("ab")
+	if got := LastFailureOffset(); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	for input, want := range map[string]float64{"x++ * 10 + x": 34, "++x * 10 + x": 44, "x-- + x": 5, "--x": 2} {
+		memory := NewMemory()
+		memory.Variables["x"] = 3
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if got, err := run(t, "x = 1\nx--3"); err != nil || got != 4 {
+		t.Errorf("x--3 = %v, %v, want 4", got, err)
+	}
+	if _, err := Eval(parse(t, Expression, "(1)++"), NewMemory()); err == nil {
+		t.Error("(1)++ was accepted")
+	}
+	_, writes := parse(t, Expression, "x++ + y").FreeVariables()
+	if strings.Join(writes, " ") != "x" {
+		t.Errorf("writes = %v, want [x]", writes)
+	}
+}
+
+func TestAbs(t *testing.T) {
+	for input, want := range map[string]float64{"|-3|": 3, "||-2| - 5|": 3, "||-1| + |-2||": 3, "2 * |1 - 4|": 6} {
+		if got := value(t, input); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	exact, err := EvalRational(parse(t, Expression, "|1/3 - 1|"), NewMemory())
+	if err != nil || exact.RatString() != "2/3" {
+		t.Errorf("rational |1/3 - 1| = %v, %v", exact, err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "f(a, b = a * 2) = a + b")
+	for input, want := range map[string]float64{"f(1, 5)": 6, "f(1)": 3} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if _, err := DeclaredFunction(parse(t, FunctionDeclaration, "g(a = 1, b) = a + b")); err == nil {
+		t.Error("a parameter without a default followed one with a default")
+	}
+	if got, err := run(t, "x = 1\ng(y = x) = y\nh(x) = g()\nh(5)"); err != nil || got != 1 {
+		t.Errorf("the default read x = %v from the caller, %v", got, err)
+	}
+}
+
+func TestSepByAny(t *testing.T) {
+	list := SepByAny("List", Digit, Character(','), Character('\n'))
+	if node := parse(t, list, "1,2\n3,\n4"); len(node.Children) != 4 {
+		t.Errorf("got %v", node)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	memory := NewMemory()
+	memory.Variables["x"] = 1
+	declare(t, memory, "f(a, b, c) = a * 100 + b * 10 + c")
+	for input, want := range map[string]float64{"(1, 2, 3)": 3, "(x++, x * 10)": 20, "f(1, 2, 3)": 123, "f((1, 2), 3, 4)": 234} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestCheckGrammar(t *testing.T) {
+	grammar := &Grammar{Skip: WS}
+	grammar.Define("Word", Choice(Pat("Variable", `[a-z]+`), Lit("if")))
+	grammar.Define("Maybe", Choice(Optional(Lit("a")), Lit("b")))
+	grammar.Define("Fine", Choice(Lit("if"), Pat("Variable", `[a-z]+`)))
+	warnings := CheckGrammar(grammar)
+	if len(warnings) != 2 || warnings[0].Rule != "Word" || warnings[1].Rule != "Maybe" {
+		t.Errorf("got %v", warnings)
+	}
+	if warnings := CheckGrammar(CalculatorGrammar()); len(warnings) != 0 {
+		t.Errorf("the calculator grammar gave %v", warnings)
+	}
+}
+
+func TestPiecewise(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "f(x) = 0 when x < 0; x otherwise")
+	if evaluate(t, parse(t, Expression, "f(-2)"), memory) != 0 || evaluate(t, parse(t, Expression, "f(3)"), memory) != 3 {
+		t.Error("the piecewise function took the wrong branch")
+	}
+	declare(t, memory, "g(x) = 1 when x > 0; 2 when x > 10")
+	if _, err := Eval(parse(t, Expression, "g(-1)"), memory); err == nil {
+		t.Error("no clause matching gave no error")
+	}
+	if value(t, "2 < 3") != 1 || value(t, "2 == 3") != 0 {
+		t.Error("comparisons should give 1 or 0")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	if node, rest, ok := Token(Literal("Plus", "+"))("  +1"); !ok || node.Value != "+" || rest != "1" {
+		t.Errorf("got %v %q %v", node, rest, ok)
+	}
+	if _, rest, _ := Trivia("  # comment\n1"); rest != "\n1" {
+		t.Errorf("left %q", rest)
+	}
+	if _, rest, _ := Trivia(" ## c"); rest != "## c" {
+		t.Errorf("## was read as a comment, leaving %q", rest)
+	}
+	parse(t, Program, "# heading\n\n1 + 2 # three\n# footer\n3")
+}
+
+func TestFloorDivision(t *testing.T) {
+	if value(t, "7 // 3") != 2 || value(t, "-7 // 3") != -3 {
+		t.Error("// should round toward negative infinity")
+	}
+	if _, err := Eval(parse(t, Expression, "1 // 0"), NewMemory()); err == nil {
+		t.Error("division by zero gave no error")
+	}
+}
+
+func TestExpect(t *testing.T) {
+	_, _, err := Parse(StrictProgram, "(1 + 2")
+	if err == nil || !strings.Contains(err.Error(), "a closing parenthesis") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestBase(t *testing.T) {
+	if got, err := FormatValue(255, EvalOptions{Base: 16}); err != nil || got != "ff" {
+		t.Errorf("255 in base 16 = %q, %v", got, err)
+	}
+	if _, err := FormatValue(2.5, EvalOptions{Base: 16}); err == nil {
+		t.Error("2.5 in base 16 gave no error")
+	}
+}
+
+func TestCountedBy(t *testing.T) {
+	item := Prefixed(Or(Character(':'), Character(' ')), Literal("A", "a"))
+	node, rest, ok := CountedBy(Digits("Count", 1), item)("3:a a a")
+	if !ok || rest != "" || len(node.Children) != 4 {
+		t.Errorf("got %v %q %v", node, rest, ok)
+	}
+	if _, _, ok := CountedBy(Digits("Count", 1), item)("3:a a"); ok {
+		t.Error("too few items matched")
+	}
+}
+
+func TestEvalStatement(t *testing.T) {
+	env := NewMemory()
+	env.Variables["x"] = 1
+	_, newEnv, err := EvalStatement(parse(t, Statement, "x = 5"), env)
+	if err != nil || newEnv.Variables["x"] != 5 || env.Variables["x"] != 1 {
+		t.Errorf("got %v, new x %v, old x %v", err, newEnv.Variables["x"], env.Variables["x"])
+	}
+}
+
+func TestTrailingComment(t *testing.T) {
+	line := parse(t, Statement, "x = 1 + 2 # three")
+	if got := line.Source(); got != "x = 1 + 2 # three" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTypedInteger(t *testing.T) {
+	if got, rest, ok := TypedInteger("10 + 5 - 3"); !ok || got != 12 || rest != "" {
+		t.Errorf("got %v %q %v", got, rest, ok)
+	}
+}
+
+func TestVariadic(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "count(xs...) = xs")
+	declare(t, memory, "second(a, xs...) = xs(1)")
+	for input, want := range map[string]float64{"count()": 0, "count(1)": 1, "count(1, 2, 3)": 3, "second(1, 2, 3)": 2} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	if _, err := DeclaredFunction(parse(t, FunctionDeclaration, "f(xs..., y) = y")); err == nil {
+		t.Error("a variadic parameter before the last gave no error")
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	for input, want := range map[string]string{
+		"x + 0":          "x",
+		"x * 1":          "x",
+		"x * 0":          "0",
+		"(x)":            "x",
+		"1 + 2 + x":      "x + 3",
+		"x + x":          "2 * x",
+		"x / 2 + x":      "x / 2 + x",
+		"2 / x + x":      "2 / x + x",
+		"x++ * 0":        "x++ * 0",
+		"++x * 0":        "++x * 0",
+		"f(x) * 0":       "f(x) * 0",
+		"0 * (x + f(1))": "0 * (x + f(1))",
+	} {
+		if got := Simplify(parse(t, Expression, input)).Source(); got != want {
+			t.Errorf("%s simplified to %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	node := parse(t, Template, "sum: {{ 1 + 2 }}!")
+	if len(node.Children) != 3 || node.Children[0].Value != "sum: " || node.Children[2].Value != "!" {
+		t.Fatalf("got %v", node)
+	}
+	embedded := node.Children[1].Children[1]
+	if got, err := Eval(embedded.Children[0], NewMemory()); err != nil || got != 3 {
+		t.Errorf("the hole is %v, %v", got, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	env := NewMemory()
+	if got, err := Run(parse(t, Program, "a = 2\nb = 3\na + b"), env); err != nil || got != 5 {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if _, ok := env.Variables["a"]; ok {
+		t.Error("Run changed the env passed in")
+	}
+	if _, err := Run(parse(t, Program, "a = 1\nb = 2"), env); err == nil {
+		t.Error("a program ending in a declaration gave no error")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	parser := NumberWithUnit("px", "s")
+	for input, unit := range map[string]interface{}{"10px": "px", "3s": "s", "10": nil} {
+		node := parse(t, parser, input)
+		if got, _ := node.Get("unit"); got != unit {
+			t.Errorf("%s has unit %v, want %v", input, got, unit)
+		}
+		if got := node.Source(); got != input {
+			t.Errorf("%s printed back as %q", input, got)
+		}
+	}
+	if _, rest, _ := parser("10sec"); rest != "sec" {
+		t.Errorf("10sec left %q", rest)
+	}
+}
+
+func TestApprox(t *testing.T) {
+	if value(t, "0.1 + 0.2 ~= 0.3") != 1 || value(t, "0.1 + 0.2 == 0.3") != 0 || value(t, "1 ~= 1.1") != 0 {
+		t.Error("~= compared wrongly")
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := Tokenize("x = 1 + f(2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := []string{}
+	for _, token := range tokens {
+		dump = append(dump, strconv.Itoa(token.Start)+" "+string(token.Type)+" "+token.Value)
+	}
+	want := "0 Variable x|2 Operator =|4 Number 1|6 Operator +|8 Variable f|9 Punctuation (|10 Number 2|11 Punctuation )"
+	if got := strings.Join(dump, "|"); got != want {
+		t.Errorf("got %s", got)
+	}
+	if _, err := Tokenize("1 \\ 2"); err == nil || err.Offset != 2 {
+		t.Errorf("got %v, want an error at offset 2", err)
+	}
+	var output strings.Builder
+	PrintTokens(&output, "test", "f(1) \\")
+	want = "0\tVariable\t\"f\"\n1\tPunctuation\t\"(\"\n2\tNumber\t\"1\"\n3\tPunctuation\t\")\"\n" +
+		"test:1:6: unexpected character '\\\\'\n"
+	if got := output.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSpecialValues(t *testing.T) {
+	if !math.IsInf(value(t, "inf"), 1) || !math.IsInf(value(t, "-inf"), -1) || !math.IsNaN(value(t, "nan")) {
+		t.Error("inf, -inf and nan have the wrong values")
+	}
+	if got, err := run(t, "infinity = 3\ninfinity"); err != nil || got != 3 {
+		t.Errorf("infinity = %v, %v", got, err)
+	}
+}
+
+func TestNodeLimit(t *testing.T) {
+	NodeLimit = 200
+	defer func() { NodeLimit = 0 }()
+	_, _, err := Parse(Program, strings.Repeat("1 + ", 200)+"1")
+	if err == nil || err.Message != "program too large" {
+		t.Errorf("got %v", err)
+	}
+	parse(t, Program, "1 + 2")
+}
+
+func TestChainedComparisons(t *testing.T) {
+	enable(t, &ChainedComparisons)
+	if value(t, "1 < 2 < 3") != 1 || value(t, "1 < 5 < 3") != 0 {
+		t.Error("the chain compared wrongly")
+	}
+	if got, err := run(t, "x = 1\n0 < x++ < 5\nx"); err != nil || got != 2 {
+		t.Errorf("the middle was evaluated %v times, %v", got-1, err)
+	}
+	if node := parse(t, Expression, "1 < 2"); node.Children[0].Type == "ComparisonChain" {
+		t.Error("a single comparison became a chain")
+	}
+}
+
+func TestTagged(t *testing.T) {
+	declaration := Tagged("Mutable", "Immutable", Literal("Var", "var "), Identifier)
+	if node, _, ok := declaration("var x"); !ok || node.Type != "Mutable" || node.Children[1].Value != "x" {
+		t.Errorf("got %v", node)
+	}
+	if node, _, ok := declaration("x"); !ok || node.Type != "Immutable" || node.Children[0].Type != Whitespace {
+		t.Errorf("got %v", node)
+	}
+}
+
+func TestFunctionArguments(t *testing.T) {
+	if got, err := run(t, "apply(f, x) = f(x)\napply(sqrt, 16)"); err != nil || got != 4 {
+		t.Errorf("apply(sqrt, 16) = %v, %v", got, err)
+	}
+	if got, err := run(t, "apply(f, x) = f(x)\ndouble(x) = x * 2\napply(double, 3)"); err != nil || got != 6 {
+		t.Errorf("apply(double, 3) = %v, %v", got, err)
+	}
+	if _, err := run(t, "g(x) = x * 2\nh(y) = y + 1\nh(g)"); err == nil {
+		t.Error("using g as a number gave no error")
+	}
+}
+
+func TestCommentPrefix(t *testing.T) {
+	defer SetCommentPrefix("#")
+	if got, err := run(t, "1 + 2 # three"); err != nil || got != 3 {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if err := SetCommentPrefix("//"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := run(t, "1 + 2 // three"); err != nil || got != 3 {
+		t.Errorf("got %v, %v", got, err)
+	}
+	for _, prefix := range []string{"", "- -", ";", "*"} {
+		if err := SetCommentPrefix(prefix); err == nil {
+			t.Errorf("the prefix %q was accepted", prefix)
+		}
+	}
+}
+
+func TestCells(t *testing.T) {
+	enable(t, &CellReferences)
+	a1 := parse(t, Expression, "A1").Children[0]
+	if column, _ := a1.Get("column"); a1.Type != "Cell" || column != "A" {
+		t.Errorf("A1 parsed as %v", a1)
+	}
+	b2 := parse(t, Expression, "$B$2").Children[0]
+	if absolute, _ := b2.Get("absoluteRow"); absolute != true {
+		t.Errorf("$B$2 parsed as %v", b2)
+	}
+	if node := parse(t, Expression, "A1:A3").Children[0]; node.Type != "CellRange" || len(node.Children) != 2 {
+		t.Errorf("A1:A3 parsed as %v", node)
+	}
+	if _, err := Eval(parse(t, Expression, "A1 + 1"), NewMemory()); err == nil {
+		t.Error("a cell without a resolver gave no error")
+	}
+	memory := NewMemory()
+	memory.Options.Cells = func(reference *Node) (float64, error) { return 41, nil }
+	if got := evaluate(t, parse(t, Expression, "A1 + 1"), memory); got != 42 {
+		t.Errorf("A1 + 1 = %v", got)
+	}
+	NodeLimit = 1
+	defer func() { NodeLimit = 0 }()
+	ResetLimits()
+	if _, _, ok := Cell("A1"); !ok {
+		t.Error("the first cell went over the node limit")
+	}
+	if _, _, ok := Cell("A1"); ok {
+		t.Error("the second cell didn't count against the node limit")
+	}
+}
+
+func TestMinimalSource(t *testing.T) {
+	for input, want := range map[string]string{
+		"(1 + 2) * 3": "(1 + 2) * 3",
+		"1 + (2 * 3)": "1 + 2 * 3",
+		"1 - (2 - 3)": "1 - (2 - 3)",
+		"(1 - 2) - 3": "1 - 2 - 3",
+		"2 ^ (3 ^ 2)": "2 ^ 3 ^ 2",
+		"(2 ^ 3) ^ 2": "(2 ^ 3) ^ 2",
+		"2(3)":        "2(3)",
+		"-(-x)":       "-(-x)",
+		"(1..2)..3":   "(1..2) .. 3",
+		"1..(2..3)":   "1 .. (2..3)",
+	} {
+		if got := parse(t, Expression, input).MinimalSource(); got != want {
+			t.Errorf("%s printed as %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestRawStrings(t *testing.T) {
+	node := parse(t, RawString, "\"\"\"a\\n\nb\"\"\"")
+	if node.Value != "a\\n\nb" {
+		t.Errorf("got %q", node.Value)
+	}
+	if got := node.Source(); got != "\"\"\"a\\n\nb\"\"\"" {
+		t.Errorf("printed as %q", got)
+	}
+	if _, _, err := Parse(StrictProgram, `"""abc`); err == nil {
+		t.Error("an unterminated raw string was accepted")
+	}
+}
+
+type recorder []string
+
+func (events *recorder) Enter(nodeType NodeType) {
+	*events = append(*events, "enter "+string(nodeType))
+}
+
+func (events *recorder) Leave(nodeType NodeType, value string) {
+	*events = append(*events, "leave "+string(nodeType)+" "+value)
+}
+
+func TestParseEvents(t *testing.T) {
+	events := &recorder{}
+	if rest, ok := ParseEvents(Statement, "2 + 3", events); !ok || rest != "" {
+		t.Fatalf("got %q, %v", rest, ok)
+	}
+	want := "enter Line|enter Expression|enter Sum|enter Number|leave Number 2|enter OpAdd|leave OpAdd +|" +
+		"enter Number|leave Number 3|leave Sum |leave Expression |leave Line "
+	if got := strings.Join(*events, "|"); got != want {
+		t.Errorf("got %s", got)
+	}
+	events = &recorder{}
+	if rest, ok := ParseEvents(Statement, "x = 1\ny = 2\nx + y", events); !ok || rest != "" {
+		t.Errorf("got %q, %v", rest, ok)
+	}
+	if got := strings.Count(strings.Join(*events, "|"), "leave Line"); got != 3 {
+		t.Errorf("got %d lines, want 3", got)
+	}
+	if rest, ok := ParseEvents(Statement, "infixl 6 (<>)\n1 <> 2", &recorder{}); !ok || rest != "" {
+		t.Errorf("a fixity declaration didn't carry over to the next statement, leaving %q", rest)
+	}
+	for _, input := range []string{"\n2 + 3", "# sum\n2 + 3\n\n"} {
+		events = &recorder{}
+		if rest, ok := ParseEvents(Statement, input, events); !ok || rest != "" || !strings.HasPrefix(strings.Join(*events, "|"), want) {
+			t.Errorf("%q: got %q, %v, %v", input, rest, ok, *events)
+		}
+	}
+	events = &recorder{}
+	if rest, ok := ParseEvents(Expression, "1\n2", events); !ok || rest != "" || len(*events) != 8 {
+		t.Errorf("Expression: got %q, %v, %v", rest, ok, *events)
+	}
+	if rest, ok := ParseEvents(Statement, "1\n)", &recorder{}); ok || rest != ")" {
+		t.Errorf("got %q, %v, want the failing statement left", rest, ok)
+	}
+}
+
+func TestSliceValues(t *testing.T) {
+	memory := NewMemory()
+	declare(t, memory, "last(xs...) = xs(-1)")
+	declare(t, memory, "middle(xs...) = xs(2:4)")
+	declare(t, memory, "tail(xs...) = xs(-2:)")
+	declare(t, memory, "head(xs...) = xs(:-1)")
+	declare(t, memory, "all(xs...) = xs(:)")
+	for input, want := range map[string]float64{
+		"last(1, 2, 3)":         3,
+		"middle(1, 2, 3, 4)":    2,
+		"middle(1, 2, 3, 4, 5)": 2,
+		"tail(1, 2, 3)":         2,
+		"head(1, 2, 3)":         2,
+		"all(1, 2, 3)":          3,
+		"all()":                 0,
+	} {
+		if got := evaluate(t, parse(t, Expression, input), memory); got != want {
+			t.Errorf("%s = %v, want %v", input, got, want)
+		}
+	}
+	declare(t, memory, "at(i, xs...) = xs(i)")
+	declare(t, memory, "from(i, xs...) = xs(i:)")
+	declare(t, memory, "between(i, j, xs...) = xs(i:j)")
+	for _, input := range []string{"at(4, 1, 2, 3)", "at(-4, 1, 2, 3)", "at(0, 1, 2, 3)", "from(5, 1, 2, 3)", "from(-4, 1, 2, 3)", "between(3, 2, 1, 2, 3)"} {
+		if _, err := Eval(parse(t, Expression, input), memory); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s gave %v, want it to be out of range", input, err)
+		}
+	}
+	if _, err := Eval(parse(t, Expression, "ys(1:2)"), memory); err == nil {
+		t.Error("slicing an undefined list gave no error")
+	}
+}